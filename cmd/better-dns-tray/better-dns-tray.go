@@ -77,6 +77,18 @@ func onReady() {
 	itemCached := systray.AddMenuItem("", "Total cached DNS requests")
 	itemErrors := systray.AddMenuItem("", "Total DNS requests that resulted in errors")
 	systray.AddSeparator()
+	itemTopLists := []*systray.MenuItem{}
+	for i := 0; i < 3; i++ {
+		item := systray.AddMenuItem("", "Lists that have blocked or allowed the most requests")
+		item.Hide()
+		itemTopLists = append(itemTopLists, item)
+	}
+	systray.AddSeparator()
+	menuPauseShort := systray.AddMenuItem("Pause blocking for 15 minutes", "Resolve everything without blocking for a while")
+	menuPauseLong := systray.AddMenuItem("Pause blocking for 1 hour", "Resolve everything without blocking for a while")
+	menuResume := systray.AddMenuItem("Resume blocking", "Stop the pause and start blocking again")
+	menuResume.Hide()
+	systray.AddSeparator()
 	menuToggleState := systray.AddMenuItem("", "Start/stop Better DNS")
 	menuQuit := systray.AddMenuItem("Quit", "Close Better DNS manager")
 
@@ -87,13 +99,20 @@ func onReady() {
 		case state := <-runner.stateCn:
 			running = state.Running
 			status := "Not running"
-			if running {
+			if running && state.Paused > 0 {
+				status = fmt.Sprintf("Running, blocking paused for %s", state.Paused.Round(time.Minute))
+				systray.SetIcon(icon.Off)
+				menuToggleState.SetTitle("Stop Better DNS")
+				menuResume.Show()
+			} else if running {
 				status = "Running"
 				systray.SetIcon(icon.On)
-				menuToggleState.SetTitle("Pause Better DNS")
+				menuToggleState.SetTitle("Stop Better DNS")
+				menuResume.Hide()
 			} else {
 				systray.SetIcon(icon.Off)
-				menuToggleState.SetTitle("Resume Better DNS")
+				menuToggleState.SetTitle("Start Better DNS")
+				menuResume.Hide()
 			}
 
 			if state.Stats == nil {
@@ -114,6 +133,25 @@ func onReady() {
 			itemCached.SetTitle(fmt.Sprintf("%s cached (%s)", humanize.Comma(int64(s.Cached)), cachePct))
 			itemErrors.SetTitle(fmt.Sprintf("%s errors (%s)", humanize.Comma(int64(s.Errors)), errorPct))
 
+			for i, item := range itemTopLists {
+				if i < len(state.TopLists) {
+					hit := state.TopLists[i]
+					item.SetTitle(fmt.Sprintf("%s hits: %s", humanize.Comma(int64(hit.Count)), hit.Name))
+					item.Show()
+				} else {
+					item.Hide()
+				}
+			}
+
+		case <-menuPauseShort.ClickedCh:
+			runner.Command("pause 15m")
+
+		case <-menuPauseLong.ClickedCh:
+			runner.Command("pause 1h")
+
+		case <-menuResume.ClickedCh:
+			runner.Command("resume")
+
 		case <-menuToggleState.ClickedCh:
 			if running {
 				runner.Stop(false)
@@ -132,6 +170,10 @@ func onReady() {
 type runnerState struct {
 	Running bool
 	Stats   *stats.Stats
+	// How much longer blocking is paused
+	Paused time.Duration
+	// The most hit lists
+	TopLists []stats.Hit
 }
 
 type betterDnsRunner struct {
@@ -193,6 +235,11 @@ func (r *betterDnsRunner) Start() {
 				if scanner.Scan() {
 					line := scanner.Text()
 
+					if strings.HasPrefix(line, "H:") {
+						r.state.TopLists = parseTopLists(strings.TrimPrefix(line, "H:"))
+						continue
+					}
+
 					parts := strings.Split(line, ",")
 					if len(parts) < 5 {
 						// Unknown line
@@ -229,6 +276,11 @@ func (r *betterDnsRunner) Start() {
 							if err == nil {
 								state.Stats.Rtt = time.Millisecond * time.Duration(v)
 							}
+						} else if strings.HasPrefix(p, "P:") {
+							v, err := strconv.ParseInt(strings.TrimPrefix(p, "P:"), 10, 64)
+							if err == nil {
+								state.Paused = time.Second * time.Duration(v)
+							}
 						}
 					}
 
@@ -299,6 +351,35 @@ func (r *betterDnsRunner) Stop(exit bool) {
 	}
 }
 
+// Send a command like "pause 15m" to better-dns
+func (r *betterDnsRunner) Command(command string) {
+	if r.cmd == nil || r.stdin == nil {
+		log.Infof("better-dns not running, ignoring command %s", command)
+		return
+	}
+
+	if _, err := r.stdin.Write([]byte(command + "\n")); err != nil {
+		log.Errorf("Failed to write command %s to better-dns: %s", command, err)
+	}
+}
+
+// Parse the "<hits> <list>" entries of the most hit lists, separated by tabs
+func parseTopLists(value string) []stats.Hit {
+	top := []stats.Hit{}
+	for _, entry := range strings.Split(value, "\t") {
+		parts := strings.SplitN(entry, " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		count, err := strconv.ParseUint(parts[0], 10, 64)
+		if err == nil {
+			top = append(top, stats.Hit{Name: parts[1], Count: count})
+		}
+	}
+	return top
+}
+
 func (r *betterDnsRunner) SendState() {
 	r.stateCn <- r.state
 }
@@ -15,7 +15,6 @@ import (
 	"path"
 	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 )
@@ -26,20 +25,6 @@ var defaultConfig = path.Join(shared.GetConfigDir(), "better-dns.yaml")
 var configFileArg = flag.String("config", defaultConfig, "Path to YAML config")
 var trayArg = flag.Bool("tray", false, "Use better-dns-tray communication protocol")
 
-func loadLists(urls []string) {
-	wg := &sync.WaitGroup{}
-	for i := range urls {
-		wg.Add(1)
-		go func(url string) {
-			server.BlockFromURL(url)
-			wg.Done()
-		}(urls[i])
-	}
-
-	wg.Wait()
-	server.LogLists()
-}
-
 func main() {
 	// Check what config file we're supposed to be using
 	flag.Parse()
@@ -73,8 +58,23 @@ func main() {
 		log.SetLevel(level)
 	}
 
+	// "better-dns explain <name>" shows why a name is blocked, instead of running the server
+	if flag.Arg(0) == "explain" {
+		explainCommand(config, flag.Args()[1:])
+		return
+	}
+
+	stats.LoadHits()
+	go stats.PersistHits()
+
 	shared.RememberDnsServers()
-	loadLists(config.BlockLists)
+	lists := server.NewLists(config)
+	lists.Load()
+	go lists.Refresh()
+
+	hosts := server.NewHosts(config)
+	hosts.Load()
+	go hosts.Watch()
 
 	handler := server.NewHandler(config)
 	port := strconv.Itoa(PORT)
@@ -98,7 +98,7 @@ func main() {
 	if !*trayArg {
 		go monitorStats()
 	} else {
-		go trayStats()
+		go trayStats(handler)
 	}
 
 	shared.UpdateDnsServers()
@@ -120,9 +120,25 @@ func main() {
 			if err != nil {
 				log.Debugf("Caught error reading stdin: %s", err)
 			} else {
-				if strings.TrimSpace(text) == "exit" {
+				command := strings.Fields(text)
+				if len(command) == 0 {
+					continue
+				}
+
+				switch command[0] {
+				case "exit":
 					log.Info("Got exit signal via stdin")
 					exitCn <- true
+				case "pause":
+					pauseCommand(handler, command[1:])
+				case "resume":
+					client := ""
+					if len(command) > 1 {
+						client = command[1]
+					}
+					handler.Resume(client)
+				default:
+					log.Errorf("Unknown command via stdin: %s", command[0])
 				}
 			}
 		}
@@ -131,9 +147,55 @@ func main() {
 	<-exitCn
 
 	shared.RestoreDnsServers()
+	stats.SaveHits()
 	log.Info("Exiting...")
 }
 
+// Handle "pause <duration> [client]", where client is an IP address, CIDR range, MAC address or client group
+func pauseCommand(handler *server.RequestHandler, args []string) {
+	if len(args) == 0 {
+		log.Errorf("Usage: pause <duration> [client]")
+		return
+	}
+
+	duration, err := time.ParseDuration(args[0])
+	if err != nil {
+		log.Errorf("Invalid pause duration %s: %s", args[0], err)
+		return
+	}
+
+	client := ""
+	if len(args) > 1 {
+		client = args[1]
+	}
+
+	if err := handler.Pause(duration, client); err != nil {
+		log.Errorf("Could not pause blocking: %s", err)
+	}
+}
+
+// Handle "explain <name>...", listing every rule matching the names in the order they are evaluated
+func explainCommand(config *shared.Config, names []string) {
+	if len(names) == 0 {
+		log.Fatalf("Usage: better-dns explain <name>...")
+	}
+
+	// Only the results are interesting, not the details of reading the lists
+	log.SetLevel(log.ErrorLevel)
+
+	lists := server.NewLists(config)
+	lists.Read()
+	server.NewHosts(config).Load()
+
+	for _, name := range names {
+		e := lists.Explain(config, name)
+		fmt.Printf("%s: %s\n", stats.CleanName(e.Name), e.Verdict)
+		for i, r := range e.Rules {
+			fmt.Printf(" %d. %s\n", i+1, r)
+		}
+	}
+}
+
 func monitorStats() {
 	duration := time.Hour
 	start := time.Now()
@@ -159,6 +221,7 @@ func monitorStats() {
 		totalErrorPct := stats.RequestPct(total.Errors, totalReqs)
 
 		diff := stats.Stats{
+			Allowed:   total.Allowed - previous.Allowed,
 			Blocked:   total.Blocked - previous.Blocked,
 			Cached:    total.Cached - previous.Cached,
 			Errors:    total.Errors - previous.Errors,
@@ -180,6 +243,7 @@ func monitorStats() {
 		log.Infof(" - Requests: %d", diffReqs)
 		log.Infof(" - Successes: %d (%s avg)", diff.Successes, diff.Rtt.Truncate(time.Millisecond))
 		log.Infof(" - Blocked: %d (%s)", diff.Blocked, diffBlockPct)
+		log.Infof(" - Allowed despite block: %d", diff.Allowed)
 		log.Infof(" - Cache hits: %d (%s, ~%s saved)", diff.Cached, diffCachePct, diffSaved)
 		log.Infof(" - Errors: %d (%s)", diff.Errors, diffErrorPct)
 
@@ -188,8 +252,23 @@ func monitorStats() {
 		log.Infof(" - Requests: %d", totalReqs)
 		log.Infof(" - Successes: %d (%s avg)", total.Successes, rtt.Truncate(time.Millisecond))
 		log.Infof(" - Blocked: %d (%s)", total.Blocked, totalBlockPct)
+		log.Infof(" - Allowed despite block: %d", total.Allowed)
 		log.Infof(" - Cache hits: %d (%s, ~%s saved)", total.Cached, totalCachePct, totalSaved)
 		log.Infof(" - Errors: %d (%s)", total.Errors, totalErrorPct)
+		for group, blocked := range total.GroupBlocked {
+			log.Infof(" - Blocked for %s: %d", group, blocked)
+		}
+
+		hits := stats.GetHits()
+		log.Infof("")
+		log.Infof("Most hit lists:")
+		for _, hit := range stats.TopHits(hits.Lists, 5) {
+			log.Infof(" - %s: %d", hit.Name, hit.Count)
+		}
+		log.Infof("Most hit rules:")
+		for _, hit := range stats.TopHits(hits.Rules, 10) {
+			log.Infof(" - %s: %d", hit.Name, hit.Count)
+		}
 		log.Infof("------------------------------")
 
 		previousRtt := previous.Rtt
@@ -198,8 +277,8 @@ func monitorStats() {
 	}
 }
 
-func trayStats() {
-	fmt.Println("S:0,B:0,C:0,E:0,R:0")
+func trayStats(handler *server.RequestHandler) {
+	fmt.Println("S:0,B:0,C:0,E:0,R:0,P:0")
 
 	duration := time.Second * 3
 	previous := stats.Stats{}
@@ -213,7 +292,15 @@ func trayStats() {
 			rtt = (previous.Rtt + total.Rtt) / time.Duration(total.Successes)
 		}
 
-		fmt.Printf("S:%d,B:%d,C:%d,E:%d,R:%d\n", total.Successes, total.Blocked, total.Cached, total.Errors, rtt/time.Millisecond)
+		paused := handler.PausedFor() / time.Second
+		fmt.Printf("S:%d,B:%d,C:%d,E:%d,R:%d,P:%d\n", total.Successes, total.Blocked, total.Cached, total.Errors, rtt/time.Millisecond, paused)
+
+		// List names can contain commas but not whitespace, so the most hit lists are sent on their own line
+		top := []string{}
+		for _, hit := range stats.TopHits(stats.GetHits().Lists, 3) {
+			top = append(top, fmt.Sprintf("%d %s", hit.Count, hit.Name))
+		}
+		fmt.Printf("H:%s\n", strings.Join(top, "\t"))
 
 		previousRtt := previous.Rtt
 		previous = total
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+)
+
+// A parsed AdBlock/AdGuard DNS filter rule, e.g. "||example.com^$important" or "@@||example.com^"
+type adblockRule struct {
+	name       string
+	exception  bool
+	subdomains bool
+	important  bool
+	dnsTypes   *dnsTypeMatcher
+	clients    *clientMatcher
+}
+
+// Reason for a rule being skipped, used to summarize what was left out of a list
+type ruleError struct {
+	reason string
+}
+
+func (e *ruleError) Error() string {
+	return e.reason
+}
+
+func unsupportedRule(format string, args ...interface{}) error {
+	return &ruleError{reason: fmt.Sprintf(format, args...)}
+}
+
+// Strip a trailing comment from a list line. Hosts lines ("0.0.0.0 ads.example.com # comment") can have one anywhere
+// after the address, other lines only after whitespace as "#" is also part of AdBlock cosmetic rules.
+func stripComment(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+		return strings.TrimSpace(strings.SplitN(line, "#", 2)[0])
+	}
+
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		if j := strings.IndexByte(line[i:], '#'); j >= 0 && strings.TrimSpace(line[i:i+j]) == "" {
+			return strings.TrimSpace(line[:i])
+		}
+	}
+
+	return line
+}
+
+// Check if line looks like AdBlock syntax rather than a hosts file line or a plain name
+func isAdblockRule(line string) bool {
+	return strings.HasPrefix(line, "|") ||
+		strings.HasPrefix(line, "@@") ||
+		strings.HasPrefix(line, "/") ||
+		strings.ContainsAny(line, "^$") ||
+		strings.Contains(line, "##") ||
+		strings.Contains(line, "#@#")
+}
+
+func parseAdblockRule(line string) (*adblockRule, error) {
+	if strings.Contains(line, "##") || strings.Contains(line, "#@#") || strings.Contains(line, "#$#") {
+		return nil, unsupportedRule("cosmetic rule")
+	}
+
+	r := &adblockRule{}
+	if strings.HasPrefix(line, "@@") {
+		r.exception = true
+		line = line[2:]
+	}
+
+	pattern := line
+	modifiers := ""
+	if i := strings.LastIndex(line, "$"); i != -1 {
+		pattern = line[:i]
+		modifiers = line[i+1:]
+	}
+
+	if strings.HasPrefix(pattern, "/") {
+		return nil, unsupportedRule("regular expression rule")
+	}
+
+	if strings.HasPrefix(pattern, "||") {
+		r.subdomains = true
+		pattern = pattern[2:]
+	} else if strings.HasPrefix(pattern, "|") {
+		pattern = pattern[1:]
+	}
+
+	pattern = strings.TrimSuffix(pattern, "|")
+	pattern = strings.TrimSuffix(pattern, "^")
+
+	if strings.Contains(pattern, "*") {
+		return nil, unsupportedRule("wildcard rule")
+	}
+
+	if strings.ContainsAny(pattern, "/:^|") {
+		return nil, unsupportedRule("URL rule")
+	}
+
+	if _, ok := dns.IsDomainName(pattern); !ok || pattern == "" {
+		return nil, unsupportedRule("invalid domain")
+	}
+
+	r.name = pattern
+
+	if modifiers == "" {
+		return r, nil
+	}
+
+	for _, modifier := range strings.Split(modifiers, ",") {
+		parts := strings.SplitN(modifier, "=", 2)
+		name := parts[0]
+		value := ""
+		if len(parts) == 2 {
+			value = parts[1]
+		}
+
+		switch name {
+		case "important":
+			r.important = true
+		case "dnstype":
+			m, err := parseDnsTypes(value)
+			if err != nil {
+				return nil, err
+			}
+			r.dnsTypes = m
+		case "client":
+			m, err := parseClients(value)
+			if err != nil {
+				return nil, err
+			}
+			r.clients = m
+		default:
+			return nil, unsupportedRule("$%s modifier", name)
+		}
+	}
+
+	return r, nil
+}
+
+// Parse "$dnstype=A|AAAA" or "$dnstype=~CNAME"
+func parseDnsTypes(value string) (*dnsTypeMatcher, error) {
+	m := &dnsTypeMatcher{}
+	for _, v := range strings.Split(value, "|") {
+		exclude := strings.HasPrefix(v, "~")
+		v = strings.TrimPrefix(v, "~")
+
+		t, ok := dns.StringToType[strings.ToUpper(v)]
+		if !ok {
+			return nil, unsupportedRule("$dnstype value %s", v)
+		}
+
+		if exclude {
+			m.exclude = append(m.exclude, t)
+		} else {
+			m.include = append(m.include, t)
+		}
+	}
+
+	return m, nil
+}
+
+// Parse "$client=192.168.1.2|~10.0.0.0/8", client names and ClientIDs are not supported
+func parseClients(value string) (*clientMatcher, error) {
+	m := &clientMatcher{}
+	for _, v := range strings.Split(value, "|") {
+		exclude := strings.HasPrefix(v, "~")
+		v = strings.TrimPrefix(v, "~")
+
+		n, err := parseIPNet(v)
+		if err != nil {
+			return nil, unsupportedRule("$client name")
+		}
+
+		if exclude {
+			m.exclude = append(m.exclude, n)
+		} else {
+			m.include = append(m.include, n)
+		}
+	}
+
+	return m, nil
+}
+
+// Parse an IP address or a CIDR range, single addresses become a /32 or /128 network
+func parseIPNet(value string) (*net.IPNet, error) {
+	if strings.Contains(value, "/") {
+		_, n, err := net.ParseCIDR(value)
+		return n, err
+	}
+
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %s", value)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"github.com/lietu/better-dns/shared"
+	"strings"
+	"testing"
+)
+
+func TestStripComment(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected string
+	}{
+		{"0.0.0.0 ads.example.com ## ad server", "0.0.0.0 ads.example.com"},
+		{"0.0.0.0 cost.example.com # costs $5", "0.0.0.0 cost.example.com"},
+		{"0.0.0.0 smile.example.com #^_^", "0.0.0.0 smile.example.com"},
+		{"0.0.0.0\tsmile.example.com#^_^", "0.0.0.0\tsmile.example.com"},
+		{"ads.example.com # costs $5", "ads.example.com"},
+		{"||example.com^ # comment", "||example.com^"},
+		{"||example.com^$important", "||example.com^$important"},
+		{"example.com##.ad", "example.com##.ad"},
+		{"example.com#@#.ad", "example.com#@#.ad"},
+	}
+
+	for _, test := range tests {
+		if result := stripComment(test.line); result != test.expected {
+			t.Errorf("stripComment(%q) = %q, expected %q", test.line, result, test.expected)
+		}
+	}
+}
+
+func TestReadListInlineComments(t *testing.T) {
+	list := strings.Join([]string{
+		"0.0.0.0 ads.example.com ## ad server",
+		"0.0.0.0 cost.example.com # costs $5",
+		"0.0.0.0 smile.example.com #^_^",
+		"plain.example.com # costs $5",
+		"||adblock.example.com^ # comment",
+	}, "\n")
+
+	f := newFilter()
+	f.readList(shared.ListConfig{URL: "test"}, strings.NewReader(list), false)
+	f.freeze()
+
+	always := func(r *rule) bool { return true }
+	for _, name := range []string{"ads.example.com", "cost.example.com", "smile.example.com", "plain.example.com", "adblock.example.com"} {
+		if r, _ := f.blockedEntries.match(name, always); r == nil {
+			t.Errorf("%s should be blocked", name)
+		}
+	}
+}
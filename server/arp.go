@@ -0,0 +1,93 @@
+package server
+
+import (
+	log "github.com/sirupsen/logrus"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the neighbour table is read again, at most
+const neighbourRefresh = 30 * time.Second
+
+// MAC addresses of the clients on the local network, from the system's ARP table
+type neighbourTable struct {
+	mutex   *sync.Mutex
+	entries map[string]string
+	updated time.Time
+	// Closed when the table currently being read is in, nil when it's not being read
+	refreshing chan bool
+}
+
+func newNeighbourTable() *neighbourTable {
+	return &neighbourTable{
+		mutex:   &sync.Mutex{},
+		entries: map[string]string{},
+	}
+}
+
+// Get the MAC address of ip, empty if it's not known. Unknown addresses wait for the table to be read again, known
+// ones never do.
+func (t *neighbourTable) lookup(ip net.IP) string {
+	key := ip.String()
+
+	t.mutex.Lock()
+	mac, ok := t.entries[key]
+	done := t.refreshing
+	if ok || (done == nil && time.Since(t.updated) <= neighbourRefresh) {
+		t.mutex.Unlock()
+		return mac
+	}
+
+	// Only one read at a time, everyone else waits for it instead of starting their own
+	if done == nil {
+		done = make(chan bool)
+		t.refreshing = done
+		t.updated = time.Now()
+		go t.refresh(done)
+	}
+	t.mutex.Unlock()
+
+	<-done
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.entries[key]
+}
+
+// Read the ARP table without holding the lock, as it can mean running a command, and swap it in
+func (t *neighbourTable) refresh(done chan bool) {
+	entries, err := readNeighbours()
+
+	t.mutex.Lock()
+	if err != nil {
+		log.Errorf("Failed to read the ARP table: %s", err)
+	} else {
+		t.entries = entries
+	}
+	t.refreshing = nil
+	t.mutex.Unlock()
+
+	close(done)
+}
+
+// Parse a MAC address from e.g. "aa-bb-cc-dd-ee-ff" or "a:b:c:d:e:f" to the form net.HardwareAddr uses
+func parseNeighbourMAC(mac string) string {
+	parts := strings.FieldsFunc(mac, func(r rune) bool {
+		return r == ':' || r == '-'
+	})
+
+	for i, part := range parts {
+		if len(part) == 1 {
+			parts[i] = "0" + part
+		}
+	}
+
+	hw, err := net.ParseMAC(strings.Join(parts, ":"))
+	if err != nil {
+		return ""
+	}
+
+	return hw.String()
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+func readNeighbours() (map[string]string, error) {
+	data, err := ioutil.ReadFile("/proc/net/arp")
+	if err != nil {
+		return nil, err
+	}
+
+	// IP address, HW type, Flags, HW address, Mask, Device
+	entries := map[string]string{}
+	for _, line := range strings.Split(string(data), "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+
+		ip := net.ParseIP(fields[0])
+		mac := parseNeighbourMAC(fields[3])
+		if ip != nil && mac != "" && mac != "00:00:00:00:00:00" {
+			entries[ip.String()] = mac
+		}
+	}
+
+	return entries, nil
+}
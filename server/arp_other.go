@@ -0,0 +1,41 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"github.com/lietu/better-dns/shared"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// Parse "arp -a", which looks like "? (192.168.1.1) at a:b:c:d:e:f on en0" on macOS and
+// "192.168.1.1    aa-bb-cc-dd-ee-ff    dynamic" on Windows
+func readNeighbours() (map[string]string, error) {
+	cmd := exec.Command("arp", "-a")
+	shared.CmdSettings(cmd)
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := map[string]string{}
+	for _, line := range strings.Split(string(output), "\n") {
+		var ip net.IP
+		mac := ""
+		for _, field := range strings.Fields(line) {
+			if ip == nil {
+				ip = net.ParseIP(strings.Trim(field, "()"))
+			} else if mac == "" {
+				mac = parseNeighbourMAC(field)
+			}
+		}
+
+		if ip != nil && mac != "" {
+			entries[ip.String()] = mac
+		}
+	}
+
+	return entries, nil
+}
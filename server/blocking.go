@@ -0,0 +1,81 @@
+package server
+
+import (
+	"github.com/lietu/better-dns/shared"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+)
+
+// How blocked requests are answered
+type blockingMode struct {
+	mode string
+	// Overrides for specific query types
+	types map[uint16]string
+	// Custom sinkhole addresses, nil for the address family that's not configured
+	ipv4 net.IP
+	ipv6 net.IP
+	ttl  uint32
+}
+
+func newBlockingMode(c shared.BlockingConfig) *blockingMode {
+	m := &blockingMode{
+		mode:  c.Mode,
+		types: map[uint16]string{},
+		ipv4:  net.ParseIP(c.IPv4),
+		ipv6:  net.ParseIP(c.IPv6),
+		ttl:   c.TTL,
+	}
+
+	for name, mode := range c.Types {
+		m.types[dns.StringToType[strings.ToUpper(name)]] = mode
+	}
+
+	return m
+}
+
+// Get the blocking mode for the query type
+func (m *blockingMode) modeFor(qtype uint16) string {
+	if mode, ok := m.types[qtype]; ok {
+		return mode
+	}
+	return m.mode
+}
+
+// Get the address to answer with for the query type in mode, nil if there's none
+func (m *blockingMode) sinkholeIP(qtype uint16, mode string) net.IP {
+	if mode == shared.BlockingModeCustomIP {
+		if qtype == dns.TypeAAAA {
+			return m.ipv6
+		}
+		return m.ipv4
+	}
+
+	if qtype == dns.TypeAAAA {
+		return net.IPv6zero
+	}
+	return net.IPv4zero
+}
+
+// Build a NXDOMAIN or NODATA response with a SOA in the authority section, so the result gets cached for the blocked
+// TTL instead of whatever the downstream resolvers default to
+func newNegativeResponse(req *dns.Msg, rcode int, ttl uint32) *dns.Msg {
+	res := new(dns.Msg)
+	res.SetRcode(req, rcode)
+	res.Authoritative = true
+	res.RecursionAvailable = true
+
+	question := req.Question[0]
+	res.Ns = []dns.RR{&dns.SOA{
+		Hdr:     dns.RR_Header{Name: question.Name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:      "blocked.better-dns.",
+		Mbox:    "hostmaster.better-dns.",
+		Serial:  1,
+		Refresh: 1800,
+		Retry:   900,
+		Expire:  604800,
+		Minttl:  ttl,
+	}}
+
+	return res
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/lietu/better-dns/shared"
+	"github.com/miekg/dns"
+)
+
+func TestFilteredResponse(t *testing.T) {
+	tests := []struct {
+		config   shared.BlockingConfig
+		qtype    uint16
+		rcode    int
+		expected net.IP
+	}{
+		{shared.BlockingConfig{Mode: shared.BlockingModeNullIP}, dns.TypeA, dns.RcodeSuccess, net.IPv4zero},
+		{shared.BlockingConfig{Mode: shared.BlockingModeNullIP}, dns.TypeAAAA, dns.RcodeSuccess, net.IPv6zero},
+		{shared.BlockingConfig{Mode: shared.BlockingModeCustomIP, IPv4: "10.0.0.1"}, dns.TypeA, dns.RcodeSuccess, net.ParseIP("10.0.0.1")},
+		{shared.BlockingConfig{Mode: shared.BlockingModeCustomIP, IPv4: "10.0.0.1"}, dns.TypeAAAA, dns.RcodeSuccess, nil},
+		{shared.BlockingConfig{Mode: shared.BlockingModeNxdomain}, dns.TypeA, dns.RcodeNameError, nil},
+		{shared.BlockingConfig{Mode: shared.BlockingModeNullIP}, dns.TypeMX, dns.RcodeSuccess, nil},
+		{shared.BlockingConfig{Mode: shared.BlockingModeNullIP, Types: map[string]string{"A": shared.BlockingModeCustomIP}, IPv4: "10.0.0.1", IPv6: "fd00::1"}, dns.TypeA, dns.RcodeSuccess, net.ParseIP("10.0.0.1")},
+		{shared.BlockingConfig{Mode: shared.BlockingModeNullIP, Types: map[string]string{"A": shared.BlockingModeCustomIP}, IPv4: "10.0.0.1", IPv6: "fd00::1"}, dns.TypeAAAA, dns.RcodeSuccess, net.IPv6zero},
+		{shared.BlockingConfig{Mode: shared.BlockingModeCustomIP, Types: map[string]string{"AAAA": shared.BlockingModeNxdomain}, IPv4: "10.0.0.1", IPv6: "fd00::1"}, dns.TypeAAAA, dns.RcodeNameError, nil},
+	}
+
+	for _, test := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion("ads.example.com.", test.qtype)
+
+		res := newFilteredResponse(req, newBlockingMode(test.config))
+		if res.Rcode != test.rcode {
+			t.Errorf("%s %s: expected rcode %s, got %s", test.config.Mode, dns.TypeToString[test.qtype], dns.RcodeToString[test.rcode], dns.RcodeToString[res.Rcode])
+			continue
+		}
+
+		var ip net.IP
+		if len(res.Answer) > 0 {
+			switch rr := res.Answer[0].(type) {
+			case *dns.A:
+				ip = rr.A
+			case *dns.AAAA:
+				ip = rr.AAAA
+			}
+		}
+
+		if !ip.Equal(test.expected) {
+			t.Errorf("%s %s: expected %v, got %v", test.config.Mode, dns.TypeToString[test.qtype], test.expected, ip)
+		}
+	}
+}
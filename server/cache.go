@@ -4,6 +4,7 @@ import (
 	"fmt"
 	lru "github.com/hashicorp/golang-lru"
 	"github.com/miekg/dns"
+	"strings"
 	"time"
 )
 
@@ -17,7 +18,7 @@ type CachedItem struct {
 	expires time.Time
 }
 
-func setCache(req *dns.Msg, res *dns.Msg) {
+func setCache(req *dns.Msg, res *dns.Msg, dnsServers []string) {
 	var ttl uint32 = 0
 
 	for i := range res.Answer {
@@ -34,7 +35,7 @@ func setCache(req *dns.Msg, res *dns.Msg) {
 		ttl = MIN_TTL
 	}
 
-	key := getEntryName(req)
+	key := getEntryName(req, dnsServers)
 	if key != "" {
 		// log.Debugf("Could cache response for %ds", ttl)
 		item := &CachedItem{}
@@ -44,20 +45,21 @@ func setCache(req *dns.Msg, res *dns.Msg) {
 	}
 }
 
-func getEntryName(r *dns.Msg) string {
+// Responses are cached separately for each set of DNS servers, as client groups can use different ones
+func getEntryName(r *dns.Msg, dnsServers []string) string {
 	if len(r.Question) > 0 {
 		q := r.Question[0]
 		t := dns.TypeToString[q.Qtype]
 		n := q.Name
 
-		return fmt.Sprintf("%s:%s", n, t)
+		return fmt.Sprintf("%s:%s:%s", n, t, strings.Join(dnsServers, ","))
 	}
 
 	return ""
 }
 
-func getCache(req *dns.Msg) *dns.Msg {
-	key := getEntryName(req)
+func getCache(req *dns.Msg, dnsServers []string) *dns.Msg {
+	key := getEntryName(req, dnsServers)
 	if cached, ok := cache.Get(key); ok {
 		cached := cached.(*CachedItem)
 
@@ -0,0 +1,284 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unsafe"
+)
+
+// Read-only form of a domain trie, built once all the rules have been added. The nodes are kept in a single array with
+// the children of each node next to each other sorted by their label, every distinct label is stored only once and
+// nodes with the same rules share them.
+type compactTrie struct {
+	nodes []compactNode
+	// All the distinct labels back to back, label i is labels[offsets[i]:offsets[i+1]]
+	labels  string
+	offsets []uint32
+	// Rule sets used by the nodes, the first one is empty
+	ruleSets [][]*rule
+}
+
+type compactNode struct {
+	label       uint32
+	firstChild  uint32
+	numChildren uint32
+	rules       uint32
+	subdomains  uint32
+}
+
+// Build the compact trie from the added entries. They're sorted by their labels in reverse, so all the names under a
+// node are next to each other and the trie can be laid out without building the nodes any other way first.
+func newCompactTrie(entries []trieEntry, onDuplicate func(r *rule)) *compactTrie {
+	c := &compactTrie{
+		offsets:  []uint32{0},
+		ruleSets: [][]*rule{nil},
+	}
+
+	// Stable to keep the rules of a name in the order they were added, later rules win over earlier ones
+	sort.SliceStable(entries, func(i, j int) bool {
+		return compareReversed(entries[i].name, entries[j].name) < 0
+	})
+
+	b := &compactBuilder{
+		compactTrie: c,
+		labelIds:    map[string]uint32{},
+		singleIds:   map[*rule]uint32{},
+		setIds:      map[string]uint32{},
+		onDuplicate: onDuplicate,
+	}
+
+	c.nodes = append(c.nodes, compactNode{})
+	b.build(0, entries, 0)
+	c.labels = b.labels.String()
+
+	return c
+}
+
+// State for building a compact trie
+type compactBuilder struct {
+	*compactTrie
+	labels   strings.Builder
+	labelIds map[string]uint32
+	// Nearly all nodes have the one rule of the list they came from, so those are looked up by the rule
+	singleIds   map[*rule]uint32
+	setIds      map[string]uint32
+	onDuplicate func(r *rule)
+}
+
+func (b *compactBuilder) labelId(label string) uint32 {
+	id, ok := b.labelIds[label]
+	if !ok {
+		b.labels.WriteString(label)
+		id = uint32(len(b.offsets) - 1)
+		b.offsets = append(b.offsets, uint32(b.labels.Len()))
+		b.labelIds[label] = id
+	}
+	return id
+}
+
+func (b *compactBuilder) ruleSetId(rules []*rule) uint32 {
+	if len(rules) == 0 {
+		return 0
+	}
+
+	if len(rules) == 1 {
+		id, ok := b.singleIds[rules[0]]
+		if !ok {
+			id = uint32(len(b.ruleSets))
+			b.ruleSets = append(b.ruleSets, rules)
+			b.singleIds[rules[0]] = id
+		}
+		return id
+	}
+
+	key := ""
+	for _, r := range rules {
+		key += fmt.Sprintf(",%p", r)
+	}
+	id, ok := b.setIds[key]
+	if !ok {
+		id = uint32(len(b.ruleSets))
+		b.ruleSets = append(b.ruleSets, rules)
+		b.setIds[key] = id
+	}
+	return id
+}
+
+// Fill in the node at index from the entries for the names at or under it, depth being the number of labels in its
+// name. The children of the node are added next to each other, followed by everything under them.
+func (b *compactBuilder) build(index int, entries []trieEntry, depth int) {
+	// The entries for the name itself sort before the ones under it
+	var rules, subdomains []*rule
+	i := 0
+	for ; i < len(entries) && labelCount(entries[i].name) == depth; i++ {
+		e := entries[i]
+		added := false
+		if e.self && !hasRule(rules, e.rule) {
+			rules = append(rules, e.rule)
+			added = true
+		}
+		if e.subdomains && !hasRule(subdomains, e.rule) {
+			subdomains = append(subdomains, e.rule)
+			added = true
+		}
+
+		// An entry is a duplicate only if the name already had all of it
+		if !added && (e.self || e.subdomains) && b.onDuplicate != nil {
+			b.onDuplicate(e.rule)
+		}
+	}
+	b.nodes[index].rules = b.ruleSetId(rules)
+	b.nodes[index].subdomains = b.ruleSetId(subdomains)
+
+	// Group the rest by the label of the child they are under
+	starts := []int{}
+	for j := i; j < len(entries); j++ {
+		if j == i || labelAt(entries[j].name, depth) != labelAt(entries[j-1].name, depth) {
+			starts = append(starts, j)
+		}
+	}
+	starts = append(starts, len(entries))
+
+	first := len(b.nodes)
+	b.nodes[index].firstChild = uint32(first)
+	b.nodes[index].numChildren = uint32(len(starts) - 1)
+	for k := 0; k < len(starts)-1; k++ {
+		b.nodes = append(b.nodes, compactNode{label: b.labelId(labelAt(entries[starts[k]].name, depth))})
+	}
+
+	for k := 0; k < len(starts)-1; k++ {
+		b.build(first+k, entries[starts[k]:starts[k+1]], depth+1)
+	}
+}
+
+// Number of labels in a normalized name
+func labelCount(name string) int {
+	return strings.Count(name, ".")
+}
+
+// Get the label of a normalized name at depth, counting from the last label
+func labelAt(name string, depth int) string {
+	label := ""
+	walkLabels(name, func(l string) bool {
+		label = l
+		depth--
+		return depth >= 0
+	})
+	return label
+}
+
+// Compare normalized names by their labels in reverse, names sort right before the names under them
+func compareReversed(a string, b string) int {
+	endA := len(a) - 1
+	endB := len(b) - 1
+	for endA > 0 && endB > 0 {
+		startA := strings.LastIndexByte(a[:endA], '.') + 1
+		startB := strings.LastIndexByte(b[:endB], '.') + 1
+		if c := strings.Compare(a[startA:endA], b[startB:endB]); c != 0 {
+			return c
+		}
+		endA = startA - 1
+		endB = startB - 1
+	}
+
+	switch {
+	case endA > 0:
+		return 1
+	case endB > 0:
+		return -1
+	}
+	return 0
+}
+
+func (c *compactTrie) label(id uint32) string {
+	return c.labels[c.offsets[id]:c.offsets[id+1]]
+}
+
+// Binary search the children of node for label
+func (c *compactTrie) child(node *compactNode, label string) *compactNode {
+	lo := node.firstChild
+	end := node.firstChild + node.numChildren
+	hi := end
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		if c.label(c.nodes[mid].label) < label {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+
+	if lo < end && c.label(c.nodes[lo].label) == label {
+		return &c.nodes[lo]
+	}
+
+	return nil
+}
+
+func (c *compactTrie) match(name string, applies func(r *rule) bool) (*rule, string) {
+	var found *rule
+	foundDepth := 0
+
+	node := &c.nodes[0]
+	depth := 0
+	matched := true
+	walkLabels(name, func(label string) bool {
+		if r := pickRule(found, c.ruleSets[node.subdomains], applies); r != found {
+			found, foundDepth = r, depth
+		}
+
+		node = c.child(node, label)
+		if node == nil {
+			matched = false
+			return false
+		}
+		depth++
+		return true
+	})
+
+	if matched {
+		if r := pickRule(found, c.ruleSets[node.rules], applies); r != found {
+			found, foundDepth = r, depth
+		}
+	}
+
+	if found == nil {
+		return nil, ""
+	}
+
+	return found, nameSuffix(name, foundDepth)
+}
+
+// Find every rule matching the name in the order match considers them
+func (c *compactTrie) matchAll(name string) []*rule {
+	found := []*rule{}
+
+	node := &c.nodes[0]
+	matched := true
+	walkLabels(name, func(label string) bool {
+		found = append(found, c.ruleSets[node.subdomains]...)
+
+		node = c.child(node, label)
+		if node == nil {
+			matched = false
+			return false
+		}
+		return true
+	})
+
+	if matched {
+		found = append(found, c.ruleSets[node.rules]...)
+	}
+
+	return found
+}
+
+// Approximate memory used, in bytes
+func (c *compactTrie) size() int {
+	size := len(c.nodes)*int(unsafe.Sizeof(compactNode{})) + len(c.labels) + len(c.offsets)*4
+	for _, rules := range c.ruleSets {
+		size += int(unsafe.Sizeof(rules)) + len(rules)*int(unsafe.Sizeof(&rule{}))
+	}
+	return size
+}
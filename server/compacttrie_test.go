@@ -0,0 +1,235 @@
+package server
+
+import (
+	"math/rand"
+	"runtime"
+	"testing"
+
+	"github.com/lietu/better-dns/shared"
+)
+
+func TestCompactTrie(t *testing.T) {
+	list := &rule{entry: &shared.BlockEntry{Src: "list"}}
+	other := &rule{entry: &shared.BlockEntry{Src: "other"}}
+	important := &rule{entry: &shared.BlockEntry{Src: "important"}, important: true}
+
+	entries := []struct {
+		name       string
+		rule       *rule
+		self       bool
+		subdomains bool
+	}{
+		{"ads.example.com", list, true, false},
+		{"ADS.example.com.", list, true, false},
+		{"tracker.com", list, true, true},
+		{"tracker.com", other, true, false},
+		{"deep.sub.tracker.com", other, true, false},
+		{"important.net", important, false, true},
+		{"name.important.net", other, true, false},
+		{"com", other, false, false},
+	}
+
+	tests := []struct {
+		name     string
+		expected *rule
+		matched  string
+	}{
+		{"ads.example.com.", list, "ads.example.com."},
+		{"Ads.Example.Com", list, "ads.example.com."},
+		{"example.com.", nil, ""},
+		{"sub.ads.example.com.", nil, ""},
+		{"tracker.com.", other, "tracker.com."},
+		{"sub.tracker.com.", list, "tracker.com."},
+		{"deep.sub.tracker.com.", other, "deep.sub.tracker.com."},
+		{"other.sub.tracker.com.", list, "tracker.com."},
+		{"important.net.", nil, ""},
+		{"name.important.net.", important, "important.net."},
+		{"com.", nil, ""},
+		{"net.", nil, ""},
+		{"unknown.org.", nil, ""},
+	}
+
+	trie := newDomainTrie()
+	compact := newDomainTrie()
+	for _, e := range entries {
+		trie.insert(e.name, e.rule, e.self, e.subdomains)
+		compact.add(e.name, e.rule, e.self, e.subdomains)
+	}
+
+	duplicates := 0
+	compact.freeze(func(r *rule) {
+		duplicates++
+	})
+	if duplicates != 1 {
+		t.Errorf("expected 1 duplicate, got %d", duplicates)
+	}
+
+	always := func(r *rule) bool { return true }
+	for _, test := range tests {
+		if r, matched := trie.match(test.name, always); r != test.expected || matched != test.matched {
+			t.Errorf("trie: %s matched %v for %q, expected %v for %q", test.name, r, matched, test.expected, test.matched)
+		}
+		if r, matched := compact.match(test.name, always); r != test.expected || matched != test.matched {
+			t.Errorf("compact: %s matched %v for %q, expected %v for %q", test.name, r, matched, test.expected, test.matched)
+		}
+		if len(trie.matchAll(test.name)) != len(compact.matchAll(test.name)) {
+			t.Errorf("%s: matchAll differs between the trie and the compact trie", test.name)
+		}
+	}
+}
+
+func TestCompareReversed(t *testing.T) {
+	tests := []struct {
+		a        string
+		b        string
+		expected int
+	}{
+		{"example.com.", "example.com.", 0},
+		{"com.", "example.com.", -1},
+		{"example.com.", "com.", 1},
+		{"a.example.com.", "b.example.com.", -1},
+		{"z.example.com.", "a.example.net.", -1},
+		{"example.com.", "a.example.com.", -1},
+		{"a.b.example.com.", "example.com.", 1},
+	}
+
+	for _, test := range tests {
+		if c := compareReversed(test.a, test.b); c != test.expected {
+			t.Errorf("compareReversed(%s, %s) = %d, expected %d", test.a, test.b, c, test.expected)
+		}
+	}
+}
+
+const benchmarkEntries = 100000
+
+// Names looking like the ones on block lists, a few labels under a small set of TLDs
+func benchmarkNames(n int) []string {
+	random := rand.New(rand.NewSource(1))
+	tlds := []string{"com", "net", "org", "io", "co.uk", "de", "ru", "info"}
+	letters := "abcdefghijklmnopqrstuvwxyz0123456789"
+
+	label := func() string {
+		b := make([]byte, 3+random.Intn(10))
+		for i := range b {
+			b[i] = letters[random.Intn(len(letters))]
+		}
+		return string(b)
+	}
+
+	domains := make([]string, n/4+1)
+	for i := range domains {
+		domains[i] = label() + "." + tlds[random.Intn(len(tlds))]
+	}
+
+	names := make([]string, n)
+	for i := range names {
+		name := domains[random.Intn(len(domains))]
+		for j := random.Intn(3); j > 0; j-- {
+			name = label() + "." + name
+		}
+		names[i] = name + "."
+	}
+
+	return names
+}
+
+// Queries with every other name on the list and every other one not on it
+func benchmarkQueries(names []string) []string {
+	queries := make([]string, len(names))
+	for i, name := range names {
+		if i%2 == 0 {
+			queries[i] = name
+		} else {
+			queries[i] = "not-listed." + name
+		}
+	}
+	return queries
+}
+
+func heapAlloc() uint64 {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc
+}
+
+func reportPerEntry(b *testing.B, bytes uint64, unit string) {
+	b.ReportMetric(float64(bytes)/benchmarkEntries, unit)
+}
+
+// The map used before the trie, one entry per name
+func buildBaselineMap(names []string) map[string]*shared.BlockEntry {
+	m := map[string]*shared.BlockEntry{}
+	for _, name := range names {
+		m[name] = &shared.BlockEntry{Src: "list"}
+	}
+	return m
+}
+
+func buildCompactTrie(names []string, r *rule) *domainTrie {
+	t := newDomainTrie()
+	for _, name := range names {
+		t.add(name, r, true, false)
+	}
+	t.freeze(nil)
+	return t
+}
+
+// Memory kept by the baseline map per entry
+func BenchmarkMemoryBaselineMap(b *testing.B) {
+	names := benchmarkNames(benchmarkEntries)
+
+	for i := 0; i < b.N; i++ {
+		before := heapAlloc()
+		m := buildBaselineMap(names)
+		reportPerEntry(b, heapAlloc()-before, "B/entry")
+		runtime.KeepAlive(m)
+	}
+}
+
+// Memory kept by the compact trie per entry, and the most used while building it, which is when the entries waiting
+// for freeze and the compact trie are both around
+func BenchmarkMemoryCompactTrie(b *testing.B) {
+	names := benchmarkNames(benchmarkEntries)
+	r := &rule{entry: &shared.BlockEntry{Src: "list"}}
+
+	for i := 0; i < b.N; i++ {
+		before := heapAlloc()
+
+		t := newDomainTrie()
+		for _, name := range names {
+			t.add(name, r, true, false)
+		}
+		pending := heapAlloc() - before
+
+		t.freeze(nil)
+		kept := heapAlloc() - before
+
+		reportPerEntry(b, kept, "B/entry")
+		reportPerEntry(b, pending+kept, "peak-B/entry")
+		runtime.KeepAlive(t)
+	}
+}
+
+func BenchmarkLookupBaselineMap(b *testing.B) {
+	names := benchmarkNames(benchmarkEntries)
+	queries := benchmarkQueries(names)
+	m := buildBaselineMap(names)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = m[queries[i%len(queries)]]
+	}
+}
+
+func BenchmarkLookupCompactTrie(b *testing.B) {
+	names := benchmarkNames(benchmarkEntries)
+	queries := benchmarkQueries(names)
+	t := buildCompactTrie(names, &rule{entry: &shared.BlockEntry{Src: "list"}})
+	always := func(r *rule) bool { return true }
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		t.match(queries[i%len(queries)], always)
+	}
+}
@@ -0,0 +1,245 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/lietu/better-dns/shared"
+	"sort"
+	"strings"
+)
+
+var actionNames = map[policyAction]string{
+	actionBlock:     "block",
+	actionNxdomain:  "NXDOMAIN",
+	actionNodata:    "NODATA",
+	actionPassthru:  "allow",
+	actionDrop:      "drop",
+	actionTcpOnly:   "TCP only",
+	actionLocalData: "local data",
+}
+
+// A rule matching the name being explained
+type ExplainedRule struct {
+	// Where the rule is evaluated, e.g. "blacklist" or "block list"
+	Stage     string
+	Entry     *shared.BlockEntry
+	Action    string
+	Important bool
+	rule      *rule
+}
+
+// Every rule matching a name in the order they are evaluated, and what happens to the name by default
+type Explanation struct {
+	Name    string
+	Rules   []ExplainedRule
+	Verdict string
+}
+
+func (r ExplainedRule) String() string {
+	src := r.Entry.Src
+	if r.Entry.Zone != "" {
+		src += fmt.Sprintf(" (RPZ %s)", r.Entry.Zone)
+	}
+	if r.Entry.Line > 0 {
+		src += fmt.Sprintf(" line %d", r.Entry.Line)
+	}
+
+	action := r.Action
+	if r.Important {
+		action += ", important"
+	}
+
+	return fmt.Sprintf("%s %s: %s (%s)", r.Stage, src, r.Entry.Rule, action)
+}
+
+// Describe where a rule comes from for the verdict
+func describeRule(r *rule) string {
+	if r.entry.Line > 0 {
+		return fmt.Sprintf("%s line %d", r.entry.Src, r.entry.Line)
+	}
+	return r.entry.Src
+}
+
+// Find every pattern matching name, each with its own entry so the pattern can be shown
+func explainPatterns(patterns []string, src string, action policyAction, name string) []*rule {
+	found := []*rule{}
+	for _, pattern := range patterns {
+		entry := &shared.BlockEntry{Src: src, Rule: pattern}
+		found = append(found, newPatternSet([]string{pattern}, entry, action, nil).matchAll(name)...)
+	}
+	return found
+}
+
+// Explain what happens to name and why, listing every rule matching it. The lists are read again one at a time with
+// the text and line of every rule, as keeping those for all the names would take several times the memory. The
+// verdict is for the default settings, $dnstype and $client restrictions and schedules are not taken into account.
+func (l *Lists) Explain(c *shared.Config, name string) *Explanation {
+	name = normalizeName(name)
+	e := &Explanation{Name: name, Rules: []ExplainedRule{}}
+	add := func(stage string, rules []*rule) {
+		for _, r := range rules {
+			e.Rules = append(e.Rules, ExplainedRule{
+				Stage:     stage,
+				Entry:     r.entry,
+				Action:    actionNames[r.action],
+				Important: r.important,
+				rule:      r,
+			})
+		}
+	}
+
+	// Rewrites and the hosts files are answered before anything is filtered
+	rewrites := []*rule{}
+	for _, rw := range c.Rewrites {
+		entry := &shared.BlockEntry{Src: "rewrites", Rule: strings.TrimSpace(fmt.Sprintf("%s %s %s", rw.Name, rw.Type, rw.Value))}
+		r := newRewriteRule(strings.ToUpper(rw.Type))
+		r.entry = entry
+		if len(explainPatterns([]string{rw.Name}, entry.Src, r.action, name)) > 0 {
+			rewrites = append(rewrites, r)
+		}
+	}
+	add("rewrite", rewrites)
+
+	hosts := []*rule{}
+	if records, ok := currentHosts().forward[name]; ok {
+		values := []string{}
+		for _, rr := range records {
+			values = append(values, answerIP(rr).String())
+		}
+		entry := &shared.BlockEntry{Src: "hosts files", Rule: strings.Join(values, ", ")}
+		hosts = append(hosts, &rule{entry: entry, action: actionLocalData})
+	}
+	add("hosts", hosts)
+
+	blacklist := explainPatterns(c.GetBlacklist(), "blacklist", actionBlock, name)
+	add("blacklist", blacklist)
+	for _, g := range c.Groups {
+		add("blacklist", explainPatterns(g.Blacklist, "blacklist of "+g.Name, actionBlock, name))
+	}
+
+	// Lists used by the default settings, the rest are only used by client groups
+	defaults := map[string]bool{}
+	for _, lists := range [][]shared.ListConfig{c.BlockLists, c.Allowlist.Lists, c.RpzZones} {
+		for _, list := range lists {
+			defaults[list.URL] = true
+		}
+	}
+
+	// The lists used by default are also read into one filter, for the verdict to be what the server does
+	combined := newFilter()
+	combined.explain = true
+
+	allowedLists := []*rule{}
+	allowedStages := map[*rule]string{}
+	for _, s := range l.sources {
+		if s.kind == ipList {
+			continue
+		}
+
+		stage := "block list"
+		if s.kind == allowList {
+			stage = "allow list"
+		} else if s.kind == rpzList {
+			stage = "RPZ"
+		}
+		if !defaults[s.config.URL] {
+			stage = "client group " + stage
+		}
+
+		lists := s.lists()
+		names := []string{}
+		for listName := range lists {
+			names = append(names, listName)
+		}
+		sort.Strings(names)
+
+		for _, listName := range names {
+			list := s.config
+			list.URL = listName
+
+			f := newFilter()
+			f.explain = true
+			f.readSource(s.kind, list, lists[listName])
+			f.freeze()
+			if defaults[s.config.URL] {
+				combined.readSource(s.kind, list, lists[listName])
+			}
+
+			add(stage, f.blockedEntries.matchAll(name))
+
+			// Allowed entries are evaluated after all the blocked ones
+			for _, r := range f.allowedEntries.matchAll(name) {
+				allowedLists = append(allowedLists, r)
+				allowedStages[r] = stage
+			}
+		}
+	}
+	combined.freeze()
+
+	allowlist := explainPatterns(c.Allowlist.Names, "allowlist", actionPassthru, name)
+	add("allowlist", allowlist)
+	for _, g := range c.Groups {
+		add("allowlist", explainPatterns(g.Allowlist.Names, "allowlist of "+g.Name, actionPassthru, name))
+	}
+	for _, r := range allowedLists {
+		add(allowedStages[r], []*rule{r})
+	}
+
+	target := ""
+	if c.SafeSearch {
+		target = safeSearchTarget(name)
+		if target != "" {
+			entry := &shared.BlockEntry{Src: "safe search", Rule: "CNAME " + target}
+			add("safe search", []*rule{{entry: entry, action: actionLocalData}})
+		}
+	}
+
+	blacklistSet := newPatternSet(c.GetBlacklist(), blackListEntry, actionBlock, nil)
+	allowlistSet := newPatternSet(c.Allowlist.Names, allowListEntry, actionPassthru, nil)
+	e.Verdict = explainVerdict(combined, name, blacklistSet, allowlistSet, len(rewrites) > 0, len(hosts) > 0, target)
+	return e
+}
+
+// Read a list of the given kind, for explaining
+func (f *Filter) readSource(kind listKind, list shared.ListConfig, body []byte) {
+	switch kind {
+	case blockList:
+		f.readList(list, bytes.NewReader(body), false)
+	case allowList:
+		f.readList(list, bytes.NewReader(body), true)
+	case rpzList:
+		f.readRPZ(list, bytes.NewReader(body))
+	}
+}
+
+// Work out what happens to the name with the default settings, matching the rules the same way the request handler
+// does
+func explainVerdict(f *Filter, name string, blacklist *patternSet, allowlist *patternSet, rewritten bool, hosts bool, target string) string {
+	always := func(r *rule) bool { return true }
+
+	switch {
+	case rewritten:
+		return "answered by the rewrites"
+	case hosts:
+		return "answered from the hosts files"
+	}
+
+	block, _ := f.blockedBy(name, blacklist, always)
+	allow, _ := f.allowedBy(name, allowlist, always)
+
+	if block != nil {
+		if allowWins(allow, block) {
+			return fmt.Sprintf("allowed by %s, overriding %s", describeRule(allow), describeRule(block))
+		}
+		if block.action != actionBlock {
+			return fmt.Sprintf("blocked by %s (%s)", describeRule(block), actionNames[block.action])
+		}
+		return fmt.Sprintf("blocked by %s", describeRule(block))
+	}
+
+	if target != "" {
+		return fmt.Sprintf("rewritten to %s by safe search", target)
+	}
+
+	return "resolved normally"
+}
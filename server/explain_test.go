@@ -0,0 +1,76 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lietu/better-dns/shared"
+	"github.com/miekg/dns"
+)
+
+// The verdict of explain should always be what the filter does, even when the lists disagree
+func TestExplainMatchesFilter(t *testing.T) {
+	tests := []struct {
+		name      string
+		lists     map[string]string
+		allowList string
+		blacklist []string
+		query     string
+	}{
+		{"more specific rule in an earlier list", map[string]string{"a": "||ads.example.com^", "b": "||example.com^"}, "", nil, "ads.example.com"},
+		{"more specific rule in a later list", map[string]string{"a": "||example.com^", "b": "ads.example.com"}, "", nil, "ads.example.com"},
+		{"important parent", map[string]string{"a": "||example.com^$important", "b": "ads.example.com"}, "", nil, "ads.example.com"},
+		{"exception in another list", map[string]string{"a": "||example.com^", "b": "@@||ads.example.com^"}, "", nil, "ads.example.com"},
+		{"exception against important", map[string]string{"a": "@@||ads.example.com^", "b": "||example.com^$important"}, "", nil, "ads.example.com"},
+		{"exception for the parent", map[string]string{"a": "@@||example.com^", "b": "||ads.example.com^"}, "", nil, "ads.example.com"},
+		{"allow list against important", map[string]string{"a": "||example.com^$important"}, "ads.example.com", nil, "ads.example.com"},
+		{"blacklist against exception", map[string]string{"a": "@@||ads.example.com^"}, "", []string{"*.example.com"}, "ads.example.com"},
+		{"not listed", map[string]string{"a": "||example.com^"}, "", nil, "example.net"},
+	}
+
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "explain")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c := &shared.Config{Blacklist: test.blacklist}
+		for name, text := range test.lists {
+			path := filepath.Join(dir, name+".txt")
+			if err := ioutil.WriteFile(path, []byte(text), 0644); err != nil {
+				t.Fatal(err)
+			}
+			c.BlockLists = append(c.BlockLists, shared.ListConfig{URL: path})
+		}
+		if test.allowList != "" {
+			path := filepath.Join(dir, "allow.txt")
+			if err := ioutil.WriteFile(path, []byte(test.allowList), 0644); err != nil {
+				t.Fatal(err)
+			}
+			c.Allowlist.Lists = append(c.Allowlist.Lists, shared.ListConfig{URL: path})
+		}
+
+		l := NewLists(c)
+		l.Read()
+		l.rebuild()
+
+		req := new(dns.Msg)
+		req.SetQuestion(dns.Fqdn(test.query), dns.TypeA)
+		blacklist := newPatternSet(c.GetBlacklist(), blackListEntry, actionBlock, nil)
+		allowlist := newPatternSet(c.Allowlist.Names, allowListEntry, actionPassthru, nil)
+		r, _ := currentFilter().filter(req, requestInfo{}, blacklist, allowlist)
+
+		verdict := l.Explain(c, test.query).Verdict
+		if r == nil && strings.HasPrefix(verdict, "blocked") {
+			t.Errorf("%s: filter allows %s, explain says %q", test.name, test.query, verdict)
+		}
+		if r != nil && !strings.HasPrefix(verdict, "blocked by "+r.entry.Src) {
+			t.Errorf("%s: filter blocks %s by %s, explain says %q", test.name, test.query, r.entry.Src, verdict)
+		}
+
+		os.RemoveAll(dir)
+	}
+}
@@ -2,43 +2,229 @@ package server
 
 import (
 	"bufio"
+	"fmt"
 	"github.com/lietu/better-dns/shared"
 	"github.com/lietu/better-dns/stats"
 	"github.com/miekg/dns"
 	"github.com/ryanuber/go-glob"
 	log "github.com/sirupsen/logrus"
-	"net"
-	"net/http"
+	"io"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 )
 
-var blockedEntries = map[string]*shared.BlockEntry{}
-var listEntries = map[string]int64{}
-var blockListMutex = &sync.Mutex{}
 var blackListEntry = &shared.BlockEntry{Src: "blacklist"}
+var allowListEntry = &shared.BlockEntry{Src: "allowlist"}
 
-func filter(req *dns.Msg, blacklist []string) *shared.BlockEntry {
-	question := req.Question[0]
-	if question.Qtype != dns.TypeA && question.Qtype != dns.TypeAAAA {
-		return nil
+// Blacklist or allowlist patterns, plain names and "*.domain" patterns are looked up from a trie, anything else is
+// matched as a glob
+type patternSet struct {
+	names *domainTrie
+	globs []globPattern
+}
+
+type globPattern struct {
+	pattern string
+	rule    *rule
+}
+
+// Build a pattern set, patterns that have schedules get their own rules that are only active on schedule
+func newPatternSet(patterns []string, entry *shared.BlockEntry, action policyAction, scheduled map[string][]*schedule) *patternSet {
+	// Configured by the user, so these win over anything from lists
+	always := &rule{entry: entry, action: action, important: true}
+
+	p := &patternSet{
+		names: newDomainTrie(),
+		globs: []globPattern{},
+	}
+
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+
+		r := always
+		if schedules, ok := scheduled[pattern]; ok {
+			r = &rule{entry: entry, action: action, important: true, schedules: schedules}
+		}
+
+		if !strings.Contains(pattern, "*") {
+			p.names.insert(pattern, r, true, false)
+		} else if strings.HasPrefix(pattern, "*.") && !strings.Contains(pattern[2:], "*") {
+			p.names.insert(pattern[2:], r, false, true)
+		} else {
+			// Names always end with a dot, so patterns should too
+			if !strings.HasSuffix(pattern, "*") && !strings.HasSuffix(pattern, ".") {
+				pattern = pattern + "."
+			}
+			p.globs = append(p.globs, globPattern{pattern: pattern, rule: r})
+		}
+	}
+
+	return p
+}
+
+// Find every pattern matching the name, the names before the globs like in match
+func (p *patternSet) matchAll(name string) []*rule {
+	found := p.names.matchAll(name)
+	for _, g := range p.globs {
+		if glob.Glob(g.pattern, name) {
+			found = append(found, g.rule)
+		}
 	}
+	return found
+}
 
-	if entry, ok := blockedEntries[question.Name]; ok {
-		return entry
+// Find the rule matching the name and the name or glob pattern it is for
+func (p *patternSet) match(name string, applies func(r *rule) bool) (*rule, string) {
+	if r, matched := p.names.match(name, applies); r != nil {
+		return r, matched
 	}
 
-	for _, pattern := range blacklist {
-		if glob.Glob(pattern, question.Name) {
-			return blackListEntry
+	for _, g := range p.globs {
+		if glob.Glob(g.pattern, name) && applies(g.rule) {
+			return g.rule, g.pattern
 		}
 	}
 
-	return nil
+	return nil, ""
+}
+
+// All the rules loaded from lists, built in full and then swapped in to replace the previous one
+type Filter struct {
+	blockedEntries     *domainTrie
+	allowedEntries     *domainTrie
+	blockedIPs         *ipTrie
+	blockedNsdnames    *domainTrie
+	listEntries        map[string]int64
+	allowListEntries   map[string]int64
+	skippedListEntries map[string]int64
+	// The configured list each list was read from, by list name, as a directory can contain several lists
+	sources map[string]string
+	// What happened to the entries of each block and allow list, by list name
+	reports map[string]*listReport
+	// Plain entries of a list all share the same rule, instead of having one for each name
+	sharedRules map[ruleKey]*rule
+	// Lists are parsed in parallel when building
+	mutex *sync.Mutex
+	// When explaining, every rule gets its own entry with the line being read, lists are read one at a time then
+	explain bool
+	line    int
+	text    string
+}
+
+type ruleKey struct {
+	list      string
+	action    policyAction
+	important bool
+}
+
+func newFilter() *Filter {
+	return &Filter{
+		blockedEntries:     newDomainTrie(),
+		allowedEntries:     newDomainTrie(),
+		blockedIPs:         newIPTrie(),
+		blockedNsdnames:    newDomainTrie(),
+		listEntries:        map[string]int64{},
+		allowListEntries:   map[string]int64{},
+		skippedListEntries: map[string]int64{},
+		sources:            map[string]string{},
+		reports:            map[string]*listReport{},
+		sharedRules:        map[ruleKey]*rule{},
+		mutex:              &sync.Mutex{},
+	}
+}
+
+// Get a function checking if a rule applies to the request
+func (f *Filter) applies(req *dns.Msg, info requestInfo) func(r *rule) bool {
+	qtype := req.Question[0].Qtype
+	return func(r *rule) bool {
+		return f.inPolicy(r, info) && r.appliesTo(qtype, info)
+	}
+}
+
+// Check if the rule is from a list used by the client's policy and currently on schedule, the blacklist and allowlist
+// are always the policy's own
+func (f *Filter) inPolicy(r *rule, info requestInfo) bool {
+	policy := info.policy
+	if policy == nil {
+		return true
+	}
+
+	list, ok := f.sources[r.entry.Src]
+	if !ok {
+		return true
+	}
+
+	return policy.lists[list] && scheduleActive(policy.schedules.lists[list], info.now)
+}
+
+// Find the rule blocking the request, if any, and the name or pattern it is for
+func (f *Filter) filter(req *dns.Msg, info requestInfo, blacklist *patternSet, allowlist *patternSet) (*rule, string) {
+	name := normalizeName(req.Question[0].Name)
+	applies := f.applies(req, info)
+
+	blocked, matched := f.blockedBy(name, blacklist, applies)
+	if blocked == nil {
+		return nil, ""
+	}
+
+	allowed, allowedMatch := f.allowedBy(name, allowlist, applies)
+	if allowWins(allowed, blocked) {
+		go stats.ReportAllowed(req, blocked.entry, allowed.entry, allowedMatch, info.group())
+		return nil, ""
+	}
+
+	return blocked, matched
+}
+
+// Allowed entries win unless the block is important and the allow is not
+func allowWins(allowed *rule, blocked *rule) bool {
+	return allowed != nil && (allowed.important || !blocked.important)
+}
+
+// Check if name is explicitly allowed for the request, regardless of it being blocked or not
+func (f *Filter) isAllowed(req *dns.Msg, info requestInfo, allowlist *patternSet) bool {
+	r, _ := f.allowedBy(normalizeName(req.Question[0].Name), allowlist, f.applies(req, info))
+	return r != nil
+}
+
+func (f *Filter) blockedBy(name string, blacklist *patternSet, applies func(r *rule) bool) (*rule, string) {
+	if r, matched := blacklist.match(name, applies); r != nil {
+		return r, matched
+	}
+
+	return f.blockedEntries.match(name, applies)
 }
 
-func newFilteredResponse(req *dns.Msg) *dns.Msg {
+func (f *Filter) allowedBy(name string, allowlist *patternSet, applies func(r *rule) bool) (*rule, string) {
+	if r, matched := allowlist.match(name, applies); r != nil {
+		return r, matched
+	}
+
+	return f.allowedEntries.match(name, applies)
+}
+
+func newFilteredResponse(req *dns.Msg, mode *blockingMode) *dns.Msg {
+	question := req.Question[0]
+
+	blockMode := mode.modeFor(question.Qtype)
+	switch blockMode {
+	case shared.BlockingModeNxdomain:
+		return newNegativeResponse(req, dns.RcodeNameError, mode.ttl)
+	case shared.BlockingModeNodata:
+		return newNegativeResponse(req, dns.RcodeSuccess, mode.ttl)
+	case shared.BlockingModeRefused:
+		res := new(dns.Msg)
+		res.SetRcode(req, dns.RcodeRefused)
+		return res
+	}
+
+	// Nothing to sinkhole for anything other than addresses, e.g. HTTPS, MX or TXT queries
+	if question.Qtype != dns.TypeA && question.Qtype != dns.TypeAAAA {
+		return newNegativeResponse(req, dns.RcodeSuccess, mode.ttl)
+	}
+
 	res := new(dns.Msg)
 	res.SetReply(req)
 
@@ -58,90 +244,232 @@ func newFilteredResponse(req *dns.Msg) *dns.Msg {
 
 	res.Compress = false
 
-	question := req.Question[0]
+	ip := mode.sinkholeIP(question.Qtype, blockMode)
+	if ip == nil {
+		return newNegativeResponse(req, dns.RcodeSuccess, mode.ttl)
+	}
 
 	if question.Qtype == dns.TypeAAAA {
-		hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: question.Qclass, Ttl: 2, Rdlength: 16}
-		res.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: net.IPv6zero}}
+		hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: question.Qclass, Ttl: mode.ttl, Rdlength: 16}
+		res.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: ip}}
 	} else {
-		hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: question.Qclass, Ttl: 2, Rdlength: 4}
-		res.Answer = []dns.RR{&dns.A{Hdr: hdr, A: net.IPv4zero}}
+		hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: question.Qclass, Ttl: mode.ttl, Rdlength: 4}
+		res.Answer = []dns.RR{&dns.A{Hdr: hdr, A: ip}}
 	}
 
 	return res
 }
 
-// Add an entry to block list
-func AddBlockedEntry(name string, list string) {
-	// DNS queries actually come in format "domain.name."
-	if name[len(name)-1:] != "." {
-		name = name + "."
+// Add an entry to block list, optionally also blocking all of its subdomains
+func (f *Filter) AddBlockedEntry(name string, list string, subdomains bool) {
+	f.addEntry(f.blockedEntries, f.listEntries, name, list, actionBlock, subdomains)
+}
+
+// Add an entry to allow list, these override any blocked entries
+func (f *Filter) AddAllowedEntry(name string, list string, subdomains bool) {
+	f.addEntry(f.allowedEntries, f.allowListEntries, name, list, actionPassthru, subdomains)
+}
+
+func (f *Filter) addEntry(entries *domainTrie, counts map[string]int64, name string, list string, action policyAction, subdomains bool) {
+	self := true
+
+	// "*.domain.name" only matches the subdomains
+	if strings.HasPrefix(name, "*.") {
+		name = name[2:]
+		self = false
+		subdomains = true
 	}
 
-	// Called from multiple goroutines so making the map and list processing safe
-	blockListMutex.Lock()
-	defer blockListMutex.Unlock()
+	// Configured allow lists are the user's own choice like the allowlist, so they win over the blacklist and
+	// "$important" blocks too
+	important := action == actionPassthru
 
-	blockedEntries[name] = &shared.BlockEntry{Src: list}
+	f.addRule(entries, counts, name, f.sharedRule(list, action, important), self, subdomains)
+}
 
-	old, ok := listEntries[list]
+// Get the rule for entries from list without any options
+func (f *Filter) sharedRule(list string, action policyAction, important bool) *rule {
+	if f.explain {
+		return &rule{entry: f.newEntry(list), action: action, important: important}
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	key := ruleKey{list: list, action: action, important: important}
+	r, ok := f.sharedRules[key]
 	if !ok {
-		old = 0
+		r = &rule{entry: &shared.BlockEntry{Src: list}, action: action, important: important}
+		f.sharedRules[key] = r
 	}
-	listEntries[list] = old + 1
+
+	return r
 }
 
-func BlockFromURL(listURL string) {
-	start := time.Now()
+// Get the entry for a rule from list, with the line being read when explaining
+func (f *Filter) newEntry(list string) *shared.BlockEntry {
+	if !f.explain {
+		return &shared.BlockEntry{Src: list}
+	}
+	return &shared.BlockEntry{Src: list, Rule: f.text, Line: f.line}
+}
 
-	req, err := http.NewRequest("GET", listURL, nil)
-	if err != nil {
-		log.Errorf("Failed to create request to %s: %s", listURL, err)
-		return
+func (f *Filter) addAdblockRule(ar *adblockRule, list shared.ListConfig, allow bool) {
+	entries := f.blockedEntries
+	counts := f.listEntries
+	action := actionBlock
+	if allow || ar.exception {
+		entries = f.allowedEntries
+		counts = f.allowListEntries
+		action = actionPassthru
 	}
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		log.Errorf("Failed to request %s: %s", listURL, err)
-		return
+	// Everything in a configured allow list wins, "@@" exceptions in block lists only over blocks that aren't important
+	important := ar.important || allow
+
+	var r *rule
+	if ar.dnsTypes == nil && ar.clients == nil {
+		r = f.sharedRule(list.URL, action, important)
+	} else {
+		r = &rule{
+			entry:     f.newEntry(list.URL),
+			action:    action,
+			important: important,
+			dnsTypes:  ar.dnsTypes,
+			clients:   ar.clients,
+		}
 	}
 
-	defer func() {
-		err := resp.Body.Close()
-		if err != nil {
-			log.Errorf("Error closing request body: %s", err)
+	f.addRule(entries, counts, ar.name, r, true, ar.subdomains || list.Subdomains)
+}
+
+func (f *Filter) addRule(entries *domainTrie, counts map[string]int64, name string, r *rule, self bool, subdomains bool) {
+	// Called from multiple goroutines so making the map and list processing safe
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	entries.add(name, r, self, subdomains)
+	countEntry(counts, r.entry.Src)
+}
+
+// Switch to the compact read-only form once all the lists have been read, duplicates within a list are found then
+func (f *Filter) freeze() {
+	duplicates := func(counts map[string]int64) func(r *rule) {
+		return func(r *rule) {
+			counts[r.entry.Src]--
+			if report, ok := f.reports[r.entry.Src]; ok {
+				report.accepted--
+				report.duplicates++
+			}
 		}
-	}()
+	}
+
+	f.blockedEntries.freeze(duplicates(f.listEntries))
+	f.allowedEntries.freeze(duplicates(f.allowListEntries))
+	f.blockedNsdnames.freeze(duplicates(f.listEntries))
+	f.sharedRules = nil
+}
 
-	scanner := bufio.NewScanner(resp.Body)
+// Approximate memory used by the names, in bytes
+func (f *Filter) size() int {
+	return f.blockedEntries.compact.size() + f.allowedEntries.compact.size() + f.blockedNsdnames.compact.size()
+}
+
+// Should be called with the filter's mutex held
+func countEntry(counts map[string]int64, list string) {
+	old, ok := counts[list]
+	if !ok {
+		old = 0
+	}
+	counts[list] = old + 1
+}
+
+// Log a summary of the rules that were skipped in a list, with the most common reasons first
+func (f *Filter) reportSkipped(listURL string, skipped map[string]int64) {
+	reasons := []string{}
+	var total int64 = 0
+	for reason, count := range skipped {
+		reasons = append(reasons, reason)
+		total += count
+	}
+
+	sort.Slice(reasons, func(i, j int) bool {
+		return skipped[reasons[i]] > skipped[reasons[j]]
+	})
+
+	details := []string{}
+	for _, reason := range reasons {
+		details = append(details, fmt.Sprintf("%s (%d)", reason, skipped[reason]))
+	}
+
+	log.Warnf("Skipped %d unsupported rules in %s: %s", total, listURL, strings.Join(details, ", "))
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.skippedListEntries[listURL] += total
+}
+
+// Parse a block or allow list in the hosts file format, one name per line, or AdBlock syntax
+func (f *Filter) readList(list shared.ListConfig, body io.Reader, allow bool) {
+	start := time.Now()
+	listURL := list.URL
+
+	addEntry := f.AddBlockedEntry
+	if allow {
+		addEntry = f.AddAllowedEntry
+	}
+
+	scanner := bufio.NewScanner(body)
 	scanner.Split(bufio.ScanLines)
+	skipped := map[string]int64{}
+	report := newListReport()
+	ownHost := listHost(listURL)
+	line := 0
 	for scanner.Scan() {
 		entry := strings.TrimSpace(scanner.Text())
 
-		// Skip clearly unnecessary lines
-		if entry == "" || entry[0:1] == "#" {
+		line++
+		if f.explain {
+			f.line = line
+			f.text = entry
+		}
+
+		// Skip clearly unnecessary lines, "!" are AdBlock comments and "[Adblock Plus 2.0]" -style headers
+		if entry == "" || entry[0:1] == "#" || entry[0:1] == "!" || entry[0:1] == "[" {
 			continue
 		}
 
-		// Strip away anything following # (comments)
-		commentParts := strings.SplitN(entry, "#", 2)
-		entry = strings.TrimSpace(commentParts[0])
+		// Comments first, so ones with characters like "$" or "^" don't make hosts lines look like AdBlock rules
+		entry = stripComment(entry)
+		if isAdblockRule(entry) {
+			ar, err := parseAdblockRule(entry)
+			if err != nil {
+				log.Debugf("Skipping rule %s: %s", entry, err)
+				skipped[err.Error()]++
+				continue
+			}
 
-		parts := strings.Split(entry, " ")
-		if len(parts) == 2 {
-			target := parts[0]
-			name := parts[1]
+			f.addAdblockRule(ar, list, allow)
+			report.accepted++
+			continue
+		}
+
+		names, reason := parseHostsLine(entry)
+		if reason != "" {
+			log.Debugf("Rejecting entry %s: %s", entry, reason)
+			report.reject(reason, entry)
+			continue
+		}
 
-			// Blackhole targets
-			if target == "0.0.0.0" || target == "::1" || target == ":::1" || target == "255.255.255.255" || (len(target) >= 4 && target[0:4] == "127.") {
-				AddBlockedEntry(name, listURL)
+		for _, name := range names {
+			host, reason := checkHostname(name, ownHost)
+			if reason != "" {
+				log.Debugf("Rejecting name %s in entry %s: %s", name, entry, reason)
+				report.reject(reason, entry)
 			} else {
-				log.Debugf("Ignoring entry: %s", entry)
+				addEntry(host, listURL, list.Subdomains)
+				report.accepted++
 			}
-		} else if len(parts) == 1 {
-			AddBlockedEntry(parts[0], listURL)
-		} else {
-			log.Debugf("Unrecognized entry: %s", entry)
 		}
 	}
 
@@ -149,16 +477,42 @@ func BlockFromURL(listURL string) {
 		log.Errorf("Error while processing list %s: %s", listURL, err)
 	}
 
+	if len(skipped) > 0 {
+		f.reportSkipped(listURL, skipped)
+	}
+
+	// Logged once the filter is built, as duplicates are only found then
+	f.mutex.Lock()
+	f.reports[listURL] = report
+	f.mutex.Unlock()
+
 	log.Debugf("✔ Parsed %s list in %s", listURL, stats.CleanDuration(time.Since(start)))
 }
 
 // Show current log lists
-func LogLists() {
+func (f *Filter) LogLists() {
+	hits := stats.GetHits()
+
+	for listURL, report := range f.reports {
+		report.log(listURL)
+	}
+
 	log.Info("Blocked entries based on given lists:")
 	var total int64 = 0
-	for key, count := range listEntries {
-		log.Infof(" - %s: %d ⛔ entries", key, count)
+	for key, count := range f.listEntries {
+		if skipped := f.skippedListEntries[key]; skipped > 0 {
+			log.Infof(" - %s: %d ⛔ entries, %d hits (%d unsupported rules skipped)", key, count, hits.Lists[key], skipped)
+		} else {
+			log.Infof(" - %s: %d ⛔ entries, %d hits", key, count, hits.Lists[key])
+		}
 		total += count
 	}
 	log.Infof("Total %d ⛔ entries", total)
+
+	if len(f.allowListEntries) > 0 {
+		log.Info("Allowed entries based on given lists:")
+		for key, count := range f.allowListEntries {
+			log.Infof(" - %s: %d ✅ entries, %d hits", key, count, hits.Lists[key])
+		}
+	}
 }
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"github.com/lietu/better-dns/shared"
+	"github.com/miekg/dns"
+	"strings"
+	"testing"
+)
+
+func TestAllowListPrecedence(t *testing.T) {
+	f := newFilter()
+	f.readList(shared.ListConfig{URL: "block"}, strings.NewReader("||important.example.com^$important\n||exception.example.com^$important\n"), false)
+	f.readList(shared.ListConfig{URL: "exceptions"}, strings.NewReader("@@||exception.example.com^\n"), false)
+	f.readList(shared.ListConfig{URL: "allow"}, strings.NewReader("important.example.com\nblacklisted.example.com\n"), true)
+	f.freeze()
+
+	blacklist := newPatternSet([]string{"blacklisted.example.com"}, blackListEntry, actionBlock, nil)
+	allowlist := newPatternSet([]string{}, allowListEntry, actionPassthru, nil)
+
+	tests := []struct {
+		name    string
+		blocked bool
+	}{
+		// Allow lists win over the blacklist and important blocks
+		{"blacklisted.example.com.", false},
+		{"important.example.com.", false},
+		// Exceptions in block lists don't win over important blocks
+		{"exception.example.com.", true},
+	}
+
+	for _, test := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(test.name, dns.TypeA)
+		if r, _ := f.filter(req, requestInfo{}, blacklist, allowlist); (r != nil) != test.blocked {
+			t.Errorf("%s blocked = %v, expected %v", test.name, r != nil, test.blocked)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"strings"
+)
+
+// DNS servers by the domain they are used for
+type forwarding map[string][]string
+
+func newForwarding(domains map[string][]string) forwarding {
+	f := forwarding{}
+	for domain, dnsServers := range domains {
+		f[normalizeName(domain)] = dnsServers
+	}
+	return f
+}
+
+// Get the DNS servers for the most specific domain name is under, nil if there are none
+func (f forwarding) dnsServersFor(name string) []string {
+	if len(f) == 0 {
+		return nil
+	}
+
+	name = normalizeName(name)
+	for name != "" {
+		if dnsServers, ok := f[name]; ok {
+			return dnsServers
+		}
+
+		dot := strings.IndexByte(name, '.')
+		name = name[dot+1:]
+	}
+
+	return nil
+}
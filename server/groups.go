@@ -0,0 +1,122 @@
+package server
+
+import (
+	"github.com/lietu/better-dns/shared"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"time"
+)
+
+// The settings used for a request, either the defaults or those of the client's group
+type clientPolicy struct {
+	// Empty for the defaults
+	group string
+	// URLs of the configured lists whose rules apply
+	lists      map[string]bool
+	blacklist  *patternSet
+	allowlist  *patternSet
+	blocking   *blockingMode
+	dnsServers []string
+	safeSearch bool
+	schedules  *schedules
+}
+
+// Clients matching any of the networks or MAC addresses use the policy
+type clientGroup struct {
+	policy   *clientPolicy
+	networks []*net.IPNet
+	macs     []string
+	// Times when the group is used, nil when always
+	schedules []*schedule
+}
+
+func newClientPolicy(group string, c *shared.Config, g shared.ClientGroup, s *schedules) *clientPolicy {
+	p := &clientPolicy{
+		group:      group,
+		lists:      map[string]bool{},
+		blacklist:  newPatternSet(g.Blacklist, blackListEntry, actionBlock, s.blacklist),
+		allowlist:  newPatternSet(g.Allowlist.Names, allowListEntry, actionPassthru, nil),
+		blocking:   newBlockingMode(g.Blocking),
+		dnsServers: g.DnsServers,
+		safeSearch: g.SafeSearch != nil && *g.SafeSearch,
+		schedules:  s,
+	}
+
+	// IP block lists and RPZ zones are not configured per group
+	for _, lists := range [][]shared.ListConfig{g.BlockLists, g.Allowlist.Lists, c.IpBlockLists, c.RpzZones} {
+		for _, list := range lists {
+			p.lists[list.URL] = true
+		}
+	}
+
+	return p
+}
+
+func newClientGroup(c *shared.Config, g shared.ClientGroup, s *schedules) *clientGroup {
+	group := &clientGroup{
+		policy:    newClientPolicy(g.Name, c, g.Merge(c), s),
+		networks:  []*net.IPNet{},
+		macs:      []string{},
+		schedules: s.groups[g.Name],
+	}
+
+	for _, client := range g.Clients {
+		network, mac, err := shared.ParseClient(client)
+		if err != nil {
+			log.Errorf("Ignoring invalid client %s in group %s: %s", client, g.Name, err)
+		} else if mac != nil {
+			group.macs = append(group.macs, mac.String())
+		} else {
+			group.networks = append(group.networks, network)
+		}
+	}
+
+	return group
+}
+
+func (g *clientGroup) matches(ip net.IP, mac func() string) bool {
+	for _, network := range g.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	if len(g.macs) == 0 {
+		return false
+	}
+
+	address := mac()
+	for _, m := range g.macs {
+		if m == address {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Find the policy for the client, the first group it belongs to that is on schedule, or the defaults
+func (h *RequestHandler) policyFor(ip net.IP, now time.Time) *clientPolicy {
+	if ip == nil {
+		return h.defaultPolicy
+	}
+
+	// Only looked up if needed, and then just once
+	address := ""
+	looked := false
+	mac := func() string {
+		if !looked {
+			address = h.neighbours.lookup(ip)
+			looked = true
+		}
+		return address
+	}
+
+	for _, g := range h.groups {
+		if scheduleActive(g.schedules, now) && g.matches(ip, mac) {
+			return g.policy
+		}
+	}
+
+	return h.defaultPolicy
+}
@@ -6,10 +6,20 @@ import (
 	"github.com/lietu/better-dns/stats"
 	"github.com/miekg/dns"
 	log "github.com/sirupsen/logrus"
+	"net"
+	"time"
 )
 
 type RequestHandler struct {
-	Config *shared.Config
+	Config        *shared.Config
+	defaultPolicy *clientPolicy
+	groups        []*clientGroup
+	neighbours    *neighbourTable
+	pauses        *pauses
+	rewrites      *domainTrie
+	forwarding    forwarding
+	rebind        *rebindProtection
+	homographs    *homographCheck
 }
 
 func writeResponse(w dns.ResponseWriter, res *dns.Msg) {
@@ -25,27 +35,183 @@ func writeResponse(w dns.ResponseWriter, res *dns.Msg) {
 	}
 }
 
-func (h *RequestHandler) getResult(req *dns.Msg) *dns.Msg {
-	if cached := getCache(req); cached != nil {
-		go stats.ReportCached(req, cached)
-		return cached
+// Get the IP address of the client making the request, the transport used and the client's group
+func (h *RequestHandler) getRequestInfo(w dns.ResponseWriter) requestInfo {
+	info := requestInfo{now: time.Now()}
+	switch addr := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		info.ip = addr.IP
+	case *net.TCPAddr:
+		info.ip = addr.IP
+		info.tcp = true
 	}
 
-	var res *dns.Msg
-	if filtered := filter(req, h.Config.GetBlacklist()); filtered != nil {
-		go stats.ReportBlocked(req, filtered)
-		res = newFilteredResponse(req)
-	} else {
-		res = client.Query(req, h.Config.GetDnsServers())
-		if res != nil {
-			// TODO: Check for blocked results in reply in case of CNAME entries
-			setCache(req, res)
+	info.policy = h.policyFor(info.ip, info.now)
+	return info
+}
+
+func (h *RequestHandler) getResult(req *dns.Msg, info requestInfo) *dns.Msg {
+	p := info.policy
+	dnsServers := h.dnsServersFor(req.Question[0].Name, p)
+	f := currentFilter()
+	paused := h.isPaused(info)
+
+	// Configured by the user, so these apply even when blocking is paused
+	if rewritten, ok := h.getRewritten(req, info); ok {
+		return rewritten
+	}
+
+	if local := currentHosts().answer(req); local != nil {
+		return local
+	}
+
+	// A private reverse lookup nobody could answer
+	if dnsServers == nil {
+		res := newNegativeResponse(req, dns.RcodeNameError, privateReverseTTL)
+		go stats.ReportLocal(req, res, "private reverse zones")
+		return res
+	}
+
+	// Filtering first, as rules can depend on the client and cached results do not
+	if !paused {
+		if filtered, matched := f.filter(req, info, p.blacklist, p.allowlist); filtered != nil {
+			if res := newPolicyResponse(req, filtered, p.blocking, dnsServers); res != nil {
+				go stats.ReportBlocked(req, filtered.entry, matched, p.group)
+				return res
+			}
+		}
+
+		if h.homographs != nil {
+			if res := h.checkHomographs(f, req, info); res != nil {
+				return res
+			}
+		}
+	}
+
+	// Not blocking as such, so this applies even when blocking is paused
+	if p.safeSearch {
+		if target := safeSearchTarget(req.Question[0].Name); target != "" {
+			go stats.ReportRewritten(req, target, "safe search", p.group)
+			return newRewriteResponse(req, target, dnsServers)
 		}
 	}
 
+	res := getCache(req, dnsServers)
+	cached := res != nil
+	if !cached {
+		res = client.Query(req, dnsServers)
+		if res == nil {
+			return nil
+		}
+
+		// The unfiltered response, as what gets filtered depends on the client
+		setCache(req, res, dnsServers)
+	}
+
+	// Checked for cached responses too, as the rules can depend on the client
+	if !paused {
+		checked, blocked := h.checkResponse(f, req, res, info, dnsServers)
+		if blocked {
+			return checked
+		} else if checked != nil {
+			res = checked
+		}
+	}
+
+	// Not blocking as such, so this applies even when blocking is paused. Names of the forwarded domains are expected
+	// to resolve to local addresses.
+	if h.rebind != nil && h.forwarding.dnsServersFor(req.Question[0].Name) == nil {
+		checked, blocked := h.rebind.check(req, res, info)
+		if blocked {
+			return checked
+		} else if checked != nil {
+			res = checked
+		}
+	}
+
+	if cached {
+		go stats.ReportCached(req, res)
+	}
+
 	return res
 }
 
+// Get the DNS servers to use for name, nil if it should not be sent anywhere
+func (h *RequestHandler) dnsServersFor(name string, p *clientPolicy) []string {
+	if dnsServers := h.forwarding.dnsServersFor(name); dnsServers != nil {
+		return dnsServers
+	}
+
+	// Public DNS servers can't answer these, and sending them would leak information about the local network
+	if isPrivateReverse(name) {
+		if len(h.Config.PrivateReverseDnsServers) > 0 {
+			return h.Config.PrivateReverseDnsServers
+		}
+		return nil
+	}
+
+	return p.dnsServers
+}
+
+// Check the name for lookalikes of other names, returns the blocked response if it should be blocked
+func (h *RequestHandler) checkHomographs(f *Filter, req *dns.Msg, info requestInfo) *dns.Msg {
+	reason, decoded := h.homographs.check(req.Question[0].Name)
+	if reason == "" || f.isAllowed(req, info, info.policy.allowlist) {
+		return nil
+	}
+
+	entry := &shared.BlockEntry{Src: "homograph protection"}
+	go stats.ReportHomograph(req, entry, decoded, reason, h.homographs.block, info.group())
+	if !h.homographs.block {
+		return nil
+	}
+
+	return newFilteredResponse(req, info.policy.blocking)
+}
+
+// Check the upstream response for blocked names in the CNAME chain and blocked answers, returns the response to use
+// instead if something was blocked, and whether the whole response was blocked
+func (h *RequestHandler) checkResponse(f *Filter, req *dns.Msg, res *dns.Msg, info requestInfo, dnsServers []string) (*dns.Msg, bool) {
+	p := info.policy
+	if f.isAllowed(req, info, p.allowlist) {
+		return nil, false
+	}
+
+	// Trackers like to hide behind CNAMEs on the site's own domain, e.g. metrics.shop.com -> tracker.eulerian.net
+	question := req.Question[0]
+	for _, rr := range res.Answer {
+		cname, ok := rr.(*dns.CNAME)
+		if !ok {
+			continue
+		}
+
+		target := new(dns.Msg)
+		target.SetQuestion(cname.Target, question.Qtype)
+		if filtered, matched := f.filter(target, info, p.blacklist, p.allowlist); filtered != nil {
+			if blocked := newPolicyResponse(req, filtered, p.blocking, dnsServers); blocked != nil {
+				go stats.ReportCnameBlocked(req, cname.Target, filtered.entry, matched, p.group)
+				return blocked, true
+			}
+		}
+	}
+
+	stripped, filtered := f.checkAnswerIPs(req, res, info, h.Config.IpBlockPolicy == "strip")
+	if filtered != nil {
+		if blocked := newPolicyResponse(req, filtered, p.blocking, dnsServers); blocked != nil {
+			return blocked, true
+		}
+	}
+
+	if nsFiltered, matched := f.checkNameServers(req, info, dnsServers); nsFiltered != nil {
+		if blocked := newPolicyResponse(req, nsFiltered, p.blocking, dnsServers); blocked != nil {
+			go stats.ReportBlocked(req, nsFiltered.entry, matched, p.group)
+			return blocked, true
+		}
+	}
+
+	return stripped, false
+}
+
 func (h *RequestHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	defer func() {
 		if err := recover(); err != nil {
@@ -56,9 +222,11 @@ func (h *RequestHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 		}
 	}()
 
-	res := h.getResult(req)
+	res := h.getResult(req, h.getRequestInfo(w))
 
-	if res != nil {
+	if res == dropResponse {
+		return
+	} else if res != nil {
 		writeResponse(w, res)
 	} else {
 		res = new(dns.Msg)
@@ -71,8 +239,31 @@ func (h *RequestHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 
 // Return a request handler for the DNS server
 func NewHandler(c *shared.Config) *RequestHandler {
+	defaults := shared.ClientGroup{
+		Blocking:   c.Blocking,
+		Allowlist:  c.Allowlist,
+		BlockLists: c.BlockLists,
+		Blacklist:  c.GetBlacklist(),
+		DnsServers: c.GetDnsServers(),
+		SafeSearch: &c.SafeSearch,
+	}
+
+	s := newSchedules(c)
 	h := &RequestHandler{
-		Config: c,
+		Config:        c,
+		defaultPolicy: newClientPolicy("", c, defaults, s),
+		groups:        []*clientGroup{},
+		neighbours:    newNeighbourTable(),
+		pauses:        newPauses(),
+		rewrites:      newRewrites(c.Rewrites),
+		forwarding:    newForwarding(c.Forwarding),
+		rebind:        newRebindProtection(c),
+		homographs:    newHomographCheck(c),
 	}
+
+	for _, g := range c.Groups {
+		h.groups = append(h.groups, newClientGroup(c, g, s))
+	}
+
 	return h
 }
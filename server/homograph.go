@@ -0,0 +1,171 @@
+package server
+
+import (
+	"fmt"
+	"github.com/lietu/better-dns/shared"
+	"strings"
+	"unicode"
+)
+
+// Scripts that are commonly mixed in a single label, e.g. Japanese names mix Han, Hiragana and Katakana with Latin
+var allowedScriptMixes = [][]string{
+	{"Latin", "Han", "Hiragana", "Katakana"},
+	{"Latin", "Han", "Hangul"},
+	{"Latin", "Han", "Bopomofo"},
+}
+
+// Characters that look like (or close enough to) Latin letters and digits, by the Latin character they look like
+var confusables = map[rune]rune{
+	// Digits
+	'0': 'o', '1': 'l',
+	// Cyrillic
+	'а': 'a', 'с': 'c', 'ԁ': 'd', 'е': 'e', 'ё': 'e', 'ɡ': 'g', 'һ': 'h', 'і': 'i', 'ї': 'i', 'ј': 'j',
+	'к': 'k', 'ӏ': 'l', 'м': 'm', 'п': 'n', 'о': 'o', 'р': 'p', 'ԛ': 'q', 'г': 'r', 'ѕ': 's', 'т': 't',
+	'ѵ': 'v', 'ԝ': 'w', 'х': 'x', 'у': 'y', 'ү': 'y',
+	// Greek
+	'α': 'a', 'β': 'b', 'ϲ': 'c', 'ε': 'e', 'η': 'n', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p', 'τ': 't',
+	'υ': 'u', 'χ': 'x', 'γ': 'y',
+	// Latin with diacritics
+	'à': 'a', 'á': 'a', 'â': 'a', 'ã': 'a', 'ä': 'a', 'å': 'a', 'ā': 'a', 'ă': 'a', 'ą': 'a', 'ɑ': 'a',
+	'ç': 'c', 'ć': 'c', 'ĉ': 'c', 'ċ': 'c', 'č': 'c',
+	'ď': 'd', 'đ': 'd',
+	'è': 'e', 'é': 'e', 'ê': 'e', 'ë': 'e', 'ē': 'e', 'ĕ': 'e', 'ė': 'e', 'ę': 'e', 'ě': 'e',
+	'ĝ': 'g', 'ğ': 'g', 'ġ': 'g', 'ģ': 'g',
+	'ĥ': 'h', 'ħ': 'h',
+	'ì': 'i', 'í': 'i', 'î': 'i', 'ï': 'i', 'ĩ': 'i', 'ī': 'i', 'ĭ': 'i', 'į': 'i', 'ı': 'i',
+	'ĵ': 'j', 'ķ': 'k',
+	'ĺ': 'l', 'ļ': 'l', 'ľ': 'l', 'ŀ': 'l', 'ł': 'l',
+	'ñ': 'n', 'ń': 'n', 'ņ': 'n', 'ň': 'n',
+	'ò': 'o', 'ó': 'o', 'ô': 'o', 'õ': 'o', 'ö': 'o', 'ø': 'o', 'ō': 'o', 'ŏ': 'o', 'ő': 'o',
+	'ŕ': 'r', 'ŗ': 'r', 'ř': 'r',
+	'ś': 's', 'ŝ': 's', 'ş': 's', 'š': 's', 'ș': 's',
+	'ţ': 't', 'ť': 't', 'ŧ': 't', 'ț': 't',
+	'ù': 'u', 'ú': 'u', 'û': 'u', 'ü': 'u', 'ũ': 'u', 'ū': 'u', 'ŭ': 'u', 'ů': 'u', 'ű': 'u', 'ų': 'u',
+	'ŵ': 'w', 'ý': 'y', 'ÿ': 'y', 'ŷ': 'y', 'ź': 'z', 'ż': 'z', 'ž': 'z',
+}
+
+// Checks internationalized names for labels mixing scripts or imitating the protected brands
+type homographCheck struct {
+	block bool
+	// Protected brand names by what they look like
+	brands map[string]string
+}
+
+func newHomographCheck(c *shared.Config) *homographCheck {
+	if c.HomographPolicy == "off" {
+		return nil
+	}
+
+	h := &homographCheck{
+		block:  c.HomographPolicy == "block",
+		brands: map[string]string{},
+	}
+
+	for _, brand := range c.HomographBrands {
+		brand = strings.ToLower(brand)
+		h.brands[skeleton(brand)] = brand
+	}
+
+	return h
+}
+
+// What the label looks like with the confusable characters replaced with the Latin ones they look like
+func skeleton(label string) string {
+	b := strings.Builder{}
+	for _, c := range label {
+		if l, ok := confusables[c]; ok {
+			c = l
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// Name of the script c is written in, empty for characters shared between scripts like digits and hyphens
+func scriptOf(c rune) string {
+	if c < 0x80 {
+		if unicode.IsLetter(c) {
+			return "Latin"
+		}
+		return ""
+	}
+
+	for name, table := range unicode.Scripts {
+		if name != "Common" && name != "Inherited" && unicode.Is(table, c) {
+			return name
+		}
+	}
+
+	return ""
+}
+
+// Check if the label uses more than one script, other than in the commonly mixed combinations
+func isMixedScript(label string) bool {
+	scripts := map[string]bool{}
+	for _, c := range label {
+		if script := scriptOf(c); script != "" {
+			scripts[script] = true
+		}
+	}
+
+	if len(scripts) < 2 {
+		return false
+	}
+
+	for _, mix := range allowedScriptMixes {
+		allowed := 0
+		for _, script := range mix {
+			if scripts[script] {
+				allowed++
+			}
+		}
+		if allowed == len(scripts) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Check the internationalized labels of name, returns the reason and the decoded name if it should be flagged
+func (h *homographCheck) check(name string) (string, string) {
+	name = normalizeName(name)
+	if !strings.Contains(name, "xn--") {
+		return "", ""
+	}
+
+	labels := strings.Split(strings.TrimSuffix(name, "."), ".")
+	decoded := make([]string, len(labels))
+	reason := ""
+	for i, label := range labels {
+		d, err := decodeIDNLabel(label)
+		if err != nil {
+			// Not something a browser would show to anyone
+			return "", ""
+		}
+		decoded[i] = d
+
+		if reason != "" || d == label {
+			continue
+		}
+
+		if isMixedScript(d) {
+			reason = fmt.Sprintf("%s mixes scripts", d)
+			continue
+		}
+
+		// Also catch lookalikes in names like "paypal-login"
+		for _, part := range strings.Split(d, "-") {
+			if brand, ok := h.brands[skeleton(part)]; ok && part != brand {
+				reason = fmt.Sprintf("%s looks like %s", d, brand)
+				break
+			}
+		}
+	}
+
+	if reason == "" {
+		return "", ""
+	}
+
+	return reason, strings.Join(decoded, ".")
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/lietu/better-dns/shared"
+)
+
+func TestHomographCheck(t *testing.T) {
+	h := newHomographCheck(&shared.Config{HomographPolicy: "block", HomographBrands: []string{"apple", "paypal"}})
+
+	tests := []struct {
+		name    string
+		reason  string
+		decoded string
+	}{
+		{"apple.com.", "", ""},
+		{"xn--pple-43d.com.", "аpple mixes scripts", "аpple.com"},
+		{"xn--80ak6aa92e.com.", "аррӏе looks like apple", "аррӏе.com"},
+		{"xn--aypal-uye.com.", "рaypal mixes scripts", "рaypal.com"},
+		{"xn--paypal-lgin-ynj.com.", "paypal-lоgin mixes scripts", "paypal-lоgin.com"},
+		{"www.xn--mnchen-3ya.de.", "", ""},
+		{"xn--wgv71a119e.jp.", "", ""},
+		{"xn--r8jz45g.jp.", "", ""},
+		{"xn--pple-43.com.", "", ""},
+	}
+
+	for _, test := range tests {
+		reason, decoded := h.check(test.name)
+		if reason != test.reason || decoded != test.decoded {
+			t.Errorf("%s: got %q (%q), expected %q (%q)", test.name, reason, decoded, test.reason, test.decoded)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/lietu/better-dns/shared"
+	"github.com/lietu/better-dns/stats"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Time to live for the records from hosts files
+const hostsTTL = 60
+
+// Records from the hosts files, answered authoritatively
+type hostsRecords struct {
+	forward map[string][]dns.RR
+	// PTR records by reverse name
+	reverse map[string][]dns.RR
+}
+
+// The system's hosts file and any configured ones, reloaded when they change
+type Hosts struct {
+	files    []string
+	modTimes map[string]time.Time
+}
+
+var activeHosts atomic.Value
+
+func init() {
+	activeHosts.Store(newHostsRecords())
+}
+
+func currentHosts() *hostsRecords {
+	return activeHosts.Load().(*hostsRecords)
+}
+
+func newHostsRecords() *hostsRecords {
+	return &hostsRecords{
+		forward: map[string][]dns.RR{},
+		reverse: map[string][]dns.RR{},
+	}
+}
+
+func systemHostsFile() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("SystemRoot"), "System32", "drivers", "etc", "hosts")
+	}
+	return "/etc/hosts"
+}
+
+func NewHosts(c *shared.Config) *Hosts {
+	h := &Hosts{
+		files:    []string{},
+		modTimes: map[string]time.Time{},
+	}
+
+	if c.SystemHosts {
+		h.files = append(h.files, systemHostsFile())
+	}
+	h.files = append(h.files, c.HostsFiles...)
+
+	return h
+}
+
+// Read all the hosts files and start answering from them
+func (h *Hosts) Load() {
+	records := newHostsRecords()
+	for _, file := range h.files {
+		info, err := os.Stat(file)
+		if err != nil {
+			log.Errorf("Failed to read hosts file %s: %s", file, err)
+			// So Watch only reloads again once the file is back
+			delete(h.modTimes, file)
+			continue
+		}
+		h.modTimes[file] = info.ModTime()
+
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Errorf("Failed to read hosts file %s: %s", file, err)
+			continue
+		}
+
+		records.read(bytes.NewReader(data))
+	}
+
+	activeHosts.Store(records)
+	log.Debugf("Serving %d names from hosts files", len(records.forward))
+}
+
+// Keep checking the hosts files for changes, reloading all of them if any changed
+func (h *Hosts) Watch() {
+	if len(h.files) == 0 {
+		return
+	}
+
+	for {
+		time.Sleep(localListInterval)
+
+		changed := false
+		for _, file := range h.files {
+			info, err := os.Stat(file)
+			if err != nil {
+				changed = changed || !h.modTimes[file].IsZero()
+				continue
+			}
+			if !info.ModTime().Equal(h.modTimes[file]) {
+				changed = true
+			}
+		}
+
+		if changed {
+			log.Info("Hosts files have changed, reloading")
+			h.Load()
+		}
+	}
+}
+
+// Parse "address name [aliases...]" lines, the first name of an address is used for its PTR record
+func (r *hostsRecords) read(body io.Reader) {
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := strings.SplitN(scanner.Text(), "#", 2)[0]
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+
+		for i, name := range fields[1:] {
+			if _, ok := dns.IsDomainName(name); !ok {
+				continue
+			}
+
+			name = normalizeName(name)
+			hdr := dns.RR_Header{Name: name, Class: dns.ClassINET, Ttl: hostsTTL}
+			if ip4 := ip.To4(); ip4 != nil {
+				hdr.Rrtype = dns.TypeA
+				r.forward[name] = append(r.forward[name], &dns.A{Hdr: hdr, A: ip4})
+			} else {
+				hdr.Rrtype = dns.TypeAAAA
+				r.forward[name] = append(r.forward[name], &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+
+			reverse, err := dns.ReverseAddr(ip.String())
+			if i == 0 && err == nil && r.reverse[reverse] == nil {
+				hdr := dns.RR_Header{Name: reverse, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: hostsTTL}
+				r.reverse[reverse] = []dns.RR{&dns.PTR{Hdr: hdr, Ptr: name}}
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Errorf("Error while reading hosts file: %s", err)
+	}
+}
+
+// Answer the request from the hosts files, nil if the name isn't in them
+func (r *hostsRecords) answer(req *dns.Msg) *dns.Msg {
+	question := req.Question[0]
+	name := normalizeName(question.Name)
+
+	records, ok := r.forward[name]
+	if !ok {
+		records, ok = r.reverse[name]
+	}
+	if !ok {
+		return nil
+	}
+
+	res := new(dns.Msg)
+	res.SetReply(req)
+	res.Authoritative = true
+	res.RecursionAvailable = true
+
+	// Other types for the name get an empty answer, as the hosts files are authoritative for it
+	for _, rr := range records {
+		if question.Qtype == dns.TypeANY || rr.Header().Rrtype == question.Qtype {
+			rr = dns.Copy(rr)
+			rr.Header().Name = question.Name
+			res.Answer = append(res.Answer, rr)
+		}
+	}
+
+	if len(res.Answer) > 0 {
+		go stats.ReportLocal(req, res, "hosts files")
+	}
+
+	return res
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Names hosts files map to the machine itself, blocking these would break things
+var reservedHostnames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+}
+
+// What happened to the entries of a block or allow list, with an example of each reason for rejecting an entry
+type listReport struct {
+	accepted   int64
+	duplicates int64
+	rejected   map[string]int64
+	examples   map[string]string
+}
+
+func newListReport() *listReport {
+	return &listReport{rejected: map[string]int64{}, examples: map[string]string{}}
+}
+
+func (r *listReport) reject(reason string, example string) {
+	r.rejected[reason]++
+	if _, ok := r.examples[reason]; !ok {
+		r.examples[reason] = strings.Join(strings.Fields(example), " ")
+	}
+}
+
+// Log the counts for the list if anything was left out, with the most common reasons first
+func (r *listReport) log(listURL string) {
+	var total int64 = 0
+	reasons := []string{}
+	for reason, count := range r.rejected {
+		reasons = append(reasons, reason)
+		total += count
+	}
+
+	if total == 0 && r.duplicates == 0 {
+		return
+	}
+
+	sort.Slice(reasons, func(i, j int) bool {
+		return r.rejected[reasons[i]] > r.rejected[reasons[j]]
+	})
+
+	details := []string{}
+	for _, reason := range reasons {
+		details = append(details, fmt.Sprintf("%s (%d, e.g. %s)", reason, r.rejected[reason], r.examples[reason]))
+	}
+
+	summary := fmt.Sprintf("%s: %d entries accepted, %d duplicates, %d rejected", listURL, r.accepted, r.duplicates, total)
+	if len(details) > 0 {
+		summary += ": " + strings.Join(details, ", ")
+	}
+	log.Info(summary)
+}
+
+// Get the host a list is downloaded from, so it's not blocked by the list itself
+func listHost(listURL string) string {
+	u, err := url.Parse(listURL)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// Check if target is an address hosts-style block lists point names to, instead of a real one
+func isBlackholeTarget(target string) bool {
+	ip := net.ParseIP(target)
+	if ip == nil {
+		return false
+	}
+	return ip.IsUnspecified() || ip.IsLoopback() || ip.Equal(net.IPv4bcast)
+}
+
+// Parse a line of a hosts file ("0.0.0.0 ads.example.com tracker.example.com") or a list of names, with any comment
+// already removed. Returns the names on the line, or why the line is rejected.
+func parseHostsLine(line string) ([]string, string) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil, ""
+	}
+
+	if len(fields) == 1 {
+		if net.ParseIP(fields[0]) != nil {
+			return nil, "address without names"
+		}
+		return fields, ""
+	}
+
+	if net.ParseIP(fields[0]) == nil {
+		return nil, "invalid address"
+	}
+
+	// Hosts files can have real addresses for some names, e.g. for the machine itself
+	if !isBlackholeTarget(fields[0]) {
+		return nil, "not a blackhole address"
+	}
+
+	return fields[1:], ""
+}
+
+// Normalize a name from a list, returns why it's rejected if it should not be blocked
+func checkHostname(name string, ownHost string) (string, string) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	host := strings.TrimPrefix(name, "*.")
+
+	switch {
+	case reservedHostnames[host]:
+		return "", "reserved name"
+	case net.ParseIP(host) != nil:
+		return "", "address as a name"
+	case host == ownHost:
+		return "", "the list's own host"
+	case len(host) > 253:
+		return "", "name too long"
+	case !strings.Contains(host, "."):
+		return "", "single label name"
+	}
+
+	for _, label := range strings.Split(host, ".") {
+		if !isValidLabel(label) {
+			return "", "invalid name"
+		}
+	}
+
+	return name, ""
+}
+
+// Underscores aren't valid in hostnames, but lists have plenty of names with them that resolve just fine
+func isValidLabel(label string) bool {
+	if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+		return false
+	}
+
+	for _, c := range label {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' && c != '_' {
+			return false
+		}
+	}
+
+	return true
+}
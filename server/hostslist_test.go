@@ -0,0 +1,175 @@
+package server
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/lietu/better-dns/shared"
+)
+
+func TestParseHostsLine(t *testing.T) {
+	tests := []struct {
+		line   string
+		names  []string
+		reason string
+	}{
+		{"", nil, ""},
+		{"ads.example.com", []string{"ads.example.com"}, ""},
+		{"0.0.0.0 ads.example.com", []string{"ads.example.com"}, ""},
+		{"0.0.0.0\tads.example.com", []string{"ads.example.com"}, ""},
+		{"127.0.0.1 \t ads.example.com", []string{"ads.example.com"}, ""},
+		{"0.0.0.0 ads.example.com tracker.example.com\tmetrics.example.com", []string{"ads.example.com", "tracker.example.com", "metrics.example.com"}, ""},
+		{":: ads.example.com", []string{"ads.example.com"}, ""},
+		{"::1 ads.example.com", []string{"ads.example.com"}, ""},
+		{"255.255.255.255 broadcasthost", []string{"broadcasthost"}, ""},
+		{"0.0.0.0", nil, "address without names"},
+		{"ads.example.com tracker.example.com", nil, "invalid address"},
+		{"0.0.0 ads.example.com", nil, "invalid address"},
+		{"192.168.1.1 router.example.com", nil, "not a blackhole address"},
+		{"fd00::1 router.example.com", nil, "not a blackhole address"},
+	}
+
+	for _, test := range tests {
+		names, reason := parseHostsLine(test.line)
+		if !reflect.DeepEqual(names, test.names) || reason != test.reason {
+			t.Errorf("%q: got %v (%q), expected %v (%q)", test.line, names, reason, test.names, test.reason)
+		}
+	}
+}
+
+func TestCheckHostname(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+		reason   string
+	}{
+		{"ads.example.com", "ads.example.com", ""},
+		{"Ads.Example.COM.", "ads.example.com", ""},
+		{"*.example.com", "*.example.com", ""},
+		{"_dmarc.example.com", "_dmarc.example.com", ""},
+		{"xn--pple-43d.com", "xn--pple-43d.com", ""},
+		{"localhost", "", "reserved name"},
+		{"localhost.localdomain", "", "reserved name"},
+		{"broadcasthost", "", "reserved name"},
+		{"ip6-allnodes", "", "reserved name"},
+		{"10.0.0.1", "", "address as a name"},
+		{"::1", "", "address as a name"},
+		{"lists.example.com", "", "the list's own host"},
+		{"example", "", "single label name"},
+		{strings.Repeat("a.", 127) + "com", "", "name too long"},
+		{strings.Repeat("a", 64) + ".com", "", "invalid name"},
+		{"-ads.example.com", "", "invalid name"},
+		{"ads-.example.com", "", "invalid name"},
+		{"ads..example.com", "", "invalid name"},
+		{"ads!.example.com", "", "invalid name"},
+		{"ads.example.com/path", "", "invalid name"},
+	}
+
+	for _, test := range tests {
+		name, reason := checkHostname(test.name, "lists.example.com")
+		if name != test.expected || reason != test.reason {
+			t.Errorf("%q: got %q (%q), expected %q (%q)", test.name, name, reason, test.expected, test.reason)
+		}
+	}
+}
+
+func TestReadHostsList(t *testing.T) {
+	tests := []struct {
+		name       string
+		lines      []string
+		blocked    []string
+		notBlocked []string
+		accepted   int64
+		duplicates int64
+		rejected   map[string]int64
+	}{
+		{
+			name: "hosts",
+			lines: []string{
+				"# A hosts file",
+				"127.0.0.1 localhost",
+				"::1 localhost ip6-localhost",
+				"255.255.255.255 broadcasthost",
+				"0.0.0.0 ads.example.com",
+				"0.0.0.0\ttracker.example.com\t# trailing comment",
+				"0.0.0.0 one.example.com two.example.com",
+				":: ipv6.example.com",
+				"0.0.0.0 ads.example.com",
+				"0.0.0.0 lists.example.com",
+				"0.0.0.0 -invalid.example.com",
+				"192.168.1.1 router.example.com",
+				"plain.example.com",
+			},
+			blocked:    []string{"ads.example.com", "tracker.example.com", "one.example.com", "two.example.com", "ipv6.example.com", "plain.example.com"},
+			notBlocked: []string{"localhost", "broadcasthost", "lists.example.com", "router.example.com"},
+			accepted:   6,
+			duplicates: 1,
+			rejected: map[string]int64{
+				"reserved name":           4,
+				"the list's own host":     1,
+				"invalid name":            1,
+				"not a blackhole address": 1,
+			},
+		},
+		{
+			name: "adblock",
+			lines: []string{
+				"! An AdBlock list",
+				"||a.example.com^",
+				"||a.example.com^",
+				"||b.example.com^",
+			},
+			blocked:    []string{"a.example.com", "sub.a.example.com", "b.example.com"},
+			notBlocked: []string{"example.com"},
+			accepted:   2,
+			duplicates: 1,
+			rejected:   map[string]int64{},
+		},
+		{
+			name: "mixed",
+			lines: []string{
+				"||a.example.com^",
+				"0.0.0.0 a.example.com",
+				"a.example.com",
+				"0.0.0.0 b.example.com # comment",
+				"||b.example.com^",
+				"||c.example.com^$important",
+				"localhost",
+			},
+			blocked:    []string{"a.example.com", "b.example.com", "c.example.com"},
+			notBlocked: []string{"localhost"},
+			accepted:   4,
+			duplicates: 2,
+			rejected:   map[string]int64{"reserved name": 1},
+		},
+	}
+
+	always := func(r *rule) bool { return true }
+	for _, test := range tests {
+		listURL := "https://lists.example.com/" + test.name
+
+		f := newFilter()
+		f.readList(shared.ListConfig{URL: listURL}, strings.NewReader(strings.Join(test.lines, "\n")), false)
+		f.freeze()
+
+		for _, name := range test.blocked {
+			if r, _ := f.blockedEntries.match(name, always); r == nil {
+				t.Errorf("%s: %s should be blocked", test.name, name)
+			}
+		}
+		for _, name := range test.notBlocked {
+			if r, _ := f.blockedEntries.match(name, always); r != nil {
+				t.Errorf("%s: %s should not be blocked", test.name, name)
+			}
+		}
+
+		report := f.reports[listURL]
+		if report.accepted != test.accepted || report.duplicates != test.duplicates || !reflect.DeepEqual(report.rejected, test.rejected) {
+			t.Errorf("%s: got %d accepted, %d duplicates, %v rejected, expected %d, %d, %v", test.name, report.accepted, report.duplicates, report.rejected, test.accepted, test.duplicates, test.rejected)
+		}
+		if count := f.listEntries[listURL]; count != test.accepted {
+			t.Errorf("%s: expected %d entries, got %d", test.name, test.accepted, count)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"bufio"
+	"github.com/lietu/better-dns/shared"
+	"github.com/lietu/better-dns/stats"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"strings"
+	"time"
+)
+
+// Block answers with addresses from a list of IP addresses and CIDR ranges, either one per line or hosts-style
+func (f *Filter) readIPList(list shared.ListConfig, body io.Reader) {
+	start := time.Now()
+	listURL := list.URL
+
+	skipped := map[string]int64{}
+	scanner := bufio.NewScanner(body)
+	scanner.Split(bufio.ScanLines)
+	for scanner.Scan() {
+		entry := scanner.Text()
+
+		// Strip away comments, both "#" and ";" are commonly used
+		entry = strings.SplitN(entry, "#", 2)[0]
+		entry = strings.TrimSpace(strings.SplitN(entry, ";", 2)[0])
+		if entry == "" {
+			continue
+		}
+
+		// Either "1.2.3.0/24" or "0.0.0.0 1.2.3.4"
+		fields := strings.Fields(entry)
+		network, err := parseIPNet(fields[len(fields)-1])
+		if err != nil || len(fields) > 2 {
+			log.Debugf("Unrecognized entry: %s", entry)
+			skipped["invalid address"]++
+			continue
+		}
+
+		f.addIPRule(network, f.sharedRule(listURL, actionBlock, false))
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Errorf("Error while processing list %s: %s", listURL, err)
+	}
+
+	if len(skipped) > 0 {
+		f.reportSkipped(listURL, skipped)
+	}
+
+	log.Debugf("✔ Parsed %s list in %s", listURL, stats.CleanDuration(time.Since(start)))
+}
+
+// Check the addresses in the answers, either returning a response to use instead or a rule that blocks the whole
+// response
+func (f *Filter) checkAnswerIPs(req *dns.Msg, res *dns.Msg, info requestInfo, strip bool) (*dns.Msg, *rule) {
+	applies := f.applies(req, info)
+
+	answers := make([]dns.RR, 0, len(res.Answer))
+	for _, rr := range res.Answer {
+		if ip := answerIP(rr); ip != nil {
+			r, network := f.blockedIPs.match(ip, applies)
+			if r != nil && r.action != actionPassthru {
+				if !strip || r.action != actionBlock {
+					go stats.ReportIPBlocked(req, ip, network, r.entry, false, info.group())
+					return nil, r
+				}
+
+				go stats.ReportIPBlocked(req, ip, network, r.entry, true, info.group())
+				continue
+			}
+		}
+
+		answers = append(answers, rr)
+	}
+
+	if len(answers) == len(res.Answer) {
+		return nil, nil
+	}
+
+	filtered := res.Copy()
+	filtered.Answer = answers
+	return filtered, nil
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"net"
+)
+
+// Binary trie of IP networks for longest prefix matching, one bit per level
+type ipTrie struct {
+	v4 *ipNode
+	v6 *ipNode
+}
+
+type ipNode struct {
+	children [2]*ipNode
+	network  *net.IPNet
+	rules    []*rule
+}
+
+func newIPTrie() *ipTrie {
+	return &ipTrie{v4: &ipNode{}, v6: &ipNode{}}
+}
+
+func (t *ipTrie) root(ip net.IP) (*ipNode, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return t.v4, ip4
+	}
+	return t.v6, ip.To16()
+}
+
+func ipBit(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
+
+func (t *ipTrie) insert(network *net.IPNet, r *rule) {
+	node, ip := t.root(network.IP)
+	size, _ := network.Mask.Size()
+	for i := 0; i < size; i++ {
+		bit := ipBit(ip, i)
+		if node.children[bit] == nil {
+			node.children[bit] = &ipNode{}
+		}
+		node = node.children[bit]
+	}
+
+	node.network = network
+	node.rules = append(node.rules, r)
+}
+
+// Find the rule for the most specific network containing ip that applies, and the network itself
+func (t *ipTrie) match(ip net.IP, applies func(r *rule) bool) (*rule, *net.IPNet) {
+	var found *rule
+	var foundNetwork *net.IPNet
+
+	node, ip := t.root(ip)
+	if ip == nil {
+		return nil, nil
+	}
+
+	for i := 0; node != nil; i++ {
+		for _, r := range node.rules {
+			if applies(r) {
+				found = r
+				foundNetwork = node.network
+			}
+		}
+
+		if i == len(ip)*8 {
+			break
+		}
+		node = node.children[ipBit(ip, i)]
+	}
+
+	return found, foundNetwork
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"github.com/lietu/better-dns/shared"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+// New versions of a list smaller than this fraction of the previous one are assumed to be broken
+const minListShrink = 0.1
+
+// Stored next to each cached list
+type listMetadata struct {
+	URL          string    `yaml:"url"`
+	ETag         string    `yaml:"etag"`
+	LastModified string    `yaml:"last_modified"`
+	Fetched      time.Time `yaml:"fetched"`
+}
+
+func getListCacheDir() string {
+	dir := path.Join(shared.GetConfigDir(), "lists")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Errorf("Failed to create list cache dir %s: %s", dir, err)
+	}
+	return dir
+}
+
+// Base path of the cache files for a list, the URL is hashed as it can contain anything
+func listCachePath(src string) string {
+	sum := sha1.Sum([]byte(src))
+	return path.Join(getListCacheDir(), hex.EncodeToString(sum[:]))
+}
+
+// Load the previously fetched version of the list from disk, returns false if there is none
+func (s *listSource) loadCache() bool {
+	base := listCachePath(s.config.URL)
+
+	body, err := ioutil.ReadFile(base + ".list")
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("Failed to read cached %s: %s", s.config.URL, err)
+		}
+		return false
+	}
+
+	meta := listMetadata{}
+	data, err := ioutil.ReadFile(base + ".yaml")
+	if err == nil {
+		err = yaml.Unmarshal(data, &meta)
+	}
+	if err != nil {
+		log.Errorf("Failed to read cache metadata for %s: %s", s.config.URL, err)
+	} else if meta.URL != s.config.URL {
+		// Hash collision or a stray file, either way it's not our list
+		return false
+	}
+
+	s.update(body, meta.ETag, meta.LastModified)
+	log.Debugf("Loaded %s from cache, fetched %s", s.config.URL, meta.Fetched.Format(time.RFC3339))
+
+	return true
+}
+
+// Store the list and its fetch metadata on disk, writing to temporary files first so a crash can't leave a partial list
+func (s *listSource) saveCache(body []byte, etag string, lastModified string) {
+	base := listCachePath(s.config.URL)
+
+	meta, err := yaml.Marshal(listMetadata{
+		URL:          s.config.URL,
+		ETag:         etag,
+		LastModified: lastModified,
+		Fetched:      time.Now(),
+	})
+	if err != nil {
+		log.Errorf("Failed to serialize cache metadata for %s: %s", s.config.URL, err)
+		return
+	}
+
+	for _, file := range []struct {
+		path string
+		data []byte
+	}{{base + ".list", body}, {base + ".yaml", meta}} {
+		tmp := file.path + ".tmp"
+		if err := ioutil.WriteFile(tmp, file.data, os.FileMode(0600)); err != nil {
+			log.Errorf("Failed to write list cache %s: %s", tmp, err)
+			return
+		}
+		if err := os.Rename(tmp, file.path); err != nil {
+			log.Errorf("Failed to replace list cache %s: %s", file.path, err)
+			return
+		}
+	}
+}
+
+// Check that a newly fetched list looks like a list, and not e.g. an error page or a truncated download
+func checkList(body []byte, previous []byte) error {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 {
+		return fmt.Errorf("list is empty")
+	}
+
+	start := trimmed
+	if len(start) > 64 {
+		start = start[:64]
+	}
+	start = bytes.ToLower(start)
+	if bytes.HasPrefix(start, []byte("<!doctype html")) || bytes.HasPrefix(start, []byte("<html")) {
+		return fmt.Errorf("got a HTML page instead of a list")
+	}
+
+	if previous != nil && float64(len(body)) < float64(len(previous))*minListShrink {
+		return fmt.Errorf("list shrank from %d to %d bytes", len(previous), len(body))
+	}
+
+	return nil
+}
@@ -0,0 +1,346 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/lietu/better-dns/shared"
+	"github.com/lietu/better-dns/stats"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type listKind int
+
+const (
+	blockList listKind = iota
+	allowList
+	ipList
+	rpzList
+)
+
+// A configured list and the latest successfully fetched version of it
+type listSource struct {
+	config  shared.ListConfig
+	kind    listKind
+	refresh time.Duration
+	// Guards the fields below, which are updated when refreshing
+	mutex        *sync.Mutex
+	etag         string
+	lastModified string
+	body         []byte
+	// Local lists, by name as a single directory can contain several lists
+	files map[string]*localFile
+}
+
+// Block, allow, IP and RPZ lists from the configuration, periodically refreshed
+type Lists struct {
+	sources   []*listSource
+	rebuildCn chan bool
+}
+
+// How long fetching a list can take, so a list host that stops responding doesn't hold up the updates for good
+const listFetchTimeout = 2 * time.Minute
+
+var listClient = &http.Client{Timeout: listFetchTimeout}
+
+var activeFilter atomic.Value
+
+func init() {
+	activeFilter.Store(newFilter())
+}
+
+// The filter currently in use, requests should only get it once to see consistent state even if it gets replaced
+func currentFilter() *Filter {
+	return activeFilter.Load().(*Filter)
+}
+
+func NewLists(c *shared.Config) *Lists {
+	l := &Lists{
+		sources:   []*listSource{},
+		rebuildCn: make(chan bool, 1),
+	}
+
+	defaultRefresh := shared.ParseRefresh(c.ListRefresh)
+	seen := map[string]bool{}
+	add := func(lists []shared.ListConfig, kind listKind) {
+		for _, list := range lists {
+			// Client groups can share lists with each other and the defaults
+			key := fmt.Sprintf("%d:%s", kind, list.URL)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			refresh := defaultRefresh
+			if list.Refresh != "" {
+				refresh = shared.ParseRefresh(list.Refresh)
+			}
+
+			s := &listSource{
+				config:  list,
+				kind:    kind,
+				refresh: refresh,
+				mutex:   &sync.Mutex{},
+				files:   map[string]*localFile{},
+			}
+
+			// Local lists are picked up as soon as they change, unless refreshing is disabled
+			if !s.isRemote() && refresh > 0 {
+				s.refresh = localListInterval
+			}
+
+			l.sources = append(l.sources, s)
+		}
+	}
+
+	add(c.BlockLists, blockList)
+	add(c.Allowlist.Lists, allowList)
+	add(c.IpBlockLists, ipList)
+	add(c.RpzZones, rpzList)
+	for _, g := range c.Groups {
+		add(g.BlockLists, blockList)
+		add(g.Allowlist.Lists, allowList)
+	}
+
+	return l
+}
+
+// Build the filter from the local lists and the cached versions of the remote ones right away, and fetch the lists in
+// the background to get any updates and the lists that are not cached yet
+func (l *Lists) Load() {
+	l.readCached()
+	l.rebuild()
+
+	go func() {
+		if l.fetchAll() {
+			l.requestRebuild()
+		}
+	}()
+}
+
+// Read the lists without building the filter, fetching the ones that are not cached yet. Returns whether all of them
+// were cached.
+func (l *Lists) Read() bool {
+	cached := l.readCached()
+	if !cached {
+		l.fetchAll()
+	}
+
+	return cached
+}
+
+// Read the local lists and the cached versions of the remote ones, returns whether all of them were cached
+func (l *Lists) readCached() bool {
+	cached := true
+	for _, s := range l.sources {
+		if !s.isRemote() {
+			if _, err := s.fetch(); err != nil {
+				log.Errorf("Failed to read %s: %s", s.config.URL, err)
+			}
+		} else if !s.loadCache() {
+			cached = false
+		}
+	}
+
+	return cached
+}
+
+// Fetch all the lists in parallel, returns whether any of them changed
+func (l *Lists) fetchAll() bool {
+	wg := &sync.WaitGroup{}
+	changed := int32(0)
+	for _, s := range l.sources {
+		wg.Add(1)
+		go func(s *listSource) {
+			defer wg.Done()
+			c, err := s.fetch()
+			if err != nil {
+				log.Errorf("Failed to request %s: %s", s.config.URL, err)
+			} else if c {
+				atomic.StoreInt32(&changed, 1)
+			}
+		}(s)
+	}
+
+	wg.Wait()
+	return changed == 1
+}
+
+// Keep refreshing the lists on their intervals, rebuilding the filter whenever some of them changed
+func (l *Lists) Refresh() {
+	for _, s := range l.sources {
+		if s.refresh > 0 {
+			go l.refreshSource(s)
+		}
+	}
+
+	for range l.rebuildCn {
+		l.rebuild()
+	}
+}
+
+func (l *Lists) refreshSource(s *listSource) {
+	for {
+		time.Sleep(s.refresh)
+
+		changed, err := s.fetch()
+		if err != nil {
+			log.Errorf("Failed to refresh %s, keeping the previous version: %s", s.config.URL, err)
+			continue
+		}
+
+		if changed {
+			log.Infof("%s has changed", s.config.URL)
+			l.requestRebuild()
+		}
+	}
+}
+
+func (l *Lists) requestRebuild() {
+	select {
+	case l.rebuildCn <- true:
+	default:
+		// Rebuild already pending, it will include any changes up to when it starts
+	}
+}
+
+// Build a new filter from the latest version of every list and swap it in place of the current one
+func (l *Lists) rebuild() {
+	start := time.Now()
+	f := newFilter()
+
+	wg := &sync.WaitGroup{}
+	for _, s := range l.sources {
+		for name, body := range s.lists() {
+			// Lists are accounted by their name, the rest of the configuration is shared
+			list := s.config
+			list.URL = name
+			f.sources[name] = s.config.URL
+
+			wg.Add(1)
+			go func(s *listSource, list shared.ListConfig, body []byte) {
+				switch s.kind {
+				case blockList:
+					f.readList(list, bytes.NewReader(body), false)
+				case allowList:
+					f.readList(list, bytes.NewReader(body), true)
+				case ipList:
+					f.readIPList(list, bytes.NewReader(body))
+				case rpzList:
+					f.readRPZ(list, bytes.NewReader(body))
+				}
+				wg.Done()
+			}(s, list, body)
+		}
+	}
+
+	wg.Wait()
+	f.freeze()
+	activeFilter.Store(f)
+
+	log.Debugf("✔ Built filter in %s, names use %d KiB", stats.CleanDuration(time.Since(start)), f.size()/1024)
+	f.LogLists()
+}
+
+// The latest version of every list from this source by name
+func (s *listSource) lists() map[string][]byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	lists := map[string][]byte{}
+	if s.body != nil {
+		lists[s.config.URL] = s.body
+	}
+	for name, file := range s.files {
+		lists[name] = file.body
+	}
+
+	return lists
+}
+
+// Fetch the list from a HTTP(S) URL or local files, returns whether it changed since the last fetch
+func (s *listSource) fetch() (bool, error) {
+	if !s.isRemote() {
+		return s.readLocal()
+	}
+
+	src := s.config.URL
+
+	req, err := http.NewRequest("GET", src, nil)
+	if err != nil {
+		return false, err
+	}
+
+	// Only get the list again if it has changed
+	s.mutex.Lock()
+	if s.etag != "" {
+		req.Header.Set("If-None-Match", s.etag)
+	}
+	if s.lastModified != "" {
+		req.Header.Set("If-Modified-Since", s.lastModified)
+	}
+	s.mutex.Unlock()
+
+	resp, err := listClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+
+	defer func() {
+		err := resp.Body.Close()
+		if err != nil {
+			log.Errorf("Error closing request body: %s", err)
+		}
+	}()
+
+	if resp.StatusCode == http.StatusNotModified {
+		log.Debugf("%s has not been modified", src)
+		return false, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected response %s", resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+
+	s.mutex.Lock()
+	previous := s.body
+	s.mutex.Unlock()
+
+	if err := checkList(body, previous); err != nil {
+		return false, err
+	}
+
+	etag := resp.Header.Get("ETag")
+	lastModified := resp.Header.Get("Last-Modified")
+	changed := s.update(body, etag, lastModified)
+	s.saveCache(body, etag, lastModified)
+
+	return changed, nil
+}
+
+// Lists fetched over HTTP(S) are cached on disk, local files are always read directly
+func (s *listSource) isRemote() bool {
+	return strings.HasPrefix(s.config.URL, "http://") || strings.HasPrefix(s.config.URL, "https://")
+}
+
+func (s *listSource) update(body []byte, etag string, lastModified string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	changed := !bytes.Equal(body, s.body)
+	s.body = body
+	s.etag = etag
+	s.lastModified = lastModified
+
+	return changed
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// How often local lists are checked for changes, only the modification times are checked so this is cheap
+const localListInterval = 10 * time.Second
+
+// A file read from a local list source
+type localFile struct {
+	modTime time.Time
+	size    int64
+	body    []byte
+}
+
+// Get the filesystem path for a "file://" URL or a plain path
+func localPath(src string) string {
+	if !strings.HasPrefix(src, "file://") {
+		return src
+	}
+
+	p := strings.TrimPrefix(src, "file://")
+	// file:///C:/lists/ads.txt on Windows
+	if len(p) > 2 && p[0] == '/' && p[2] == ':' {
+		p = p[1:]
+	}
+
+	return filepath.FromSlash(p)
+}
+
+// Read a local file or every file in a local directory, only reading files that have changed since last time
+func (s *listSource) readLocal() (bool, error) {
+	p := localPath(s.config.URL)
+	info, err := os.Stat(p)
+	if err != nil {
+		return false, err
+	}
+
+	// Name the lists from a directory by their files so they get counted separately
+	paths := map[string]string{}
+	if info.IsDir() {
+		entries, err := ioutil.ReadDir(p)
+		if err != nil {
+			return false, err
+		}
+
+		for _, entry := range entries {
+			// Skip hidden files, editor swap files and such
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || strings.HasSuffix(entry.Name(), "~") {
+				continue
+			}
+			file := filepath.Join(p, entry.Name())
+			paths[file] = file
+		}
+	} else {
+		paths[s.config.URL] = p
+	}
+
+	s.mutex.Lock()
+	previous := s.files
+	s.mutex.Unlock()
+
+	changed := len(paths) != len(previous)
+	files := map[string]*localFile{}
+	for name, file := range paths {
+		info, err := os.Stat(file)
+		if err != nil {
+			log.Errorf("Failed to check %s: %s", file, err)
+			continue
+		}
+
+		if old, ok := previous[name]; ok && old.modTime.Equal(info.ModTime()) && old.size == info.Size() {
+			files[name] = old
+			continue
+		}
+
+		body, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Errorf("Failed to read %s: %s", file, err)
+			continue
+		}
+
+		files[name] = &localFile{modTime: info.ModTime(), size: info.Size(), body: body}
+		changed = true
+	}
+
+	s.mutex.Lock()
+	s.files = files
+	s.mutex.Unlock()
+
+	return changed, nil
+}
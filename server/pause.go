@@ -0,0 +1,164 @@
+package server
+
+import (
+	"fmt"
+	"github.com/lietu/better-dns/shared"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sync"
+	"time"
+)
+
+// Filtering paused for everyone or for some clients until the given times, requests are still resolved normally
+type pauses struct {
+	mutex *sync.Mutex
+	all   time.Time
+	// By client IP address or group name
+	clients map[string]time.Time
+	// By CIDR range or MAC address
+	networks map[string]pausedNetwork
+}
+
+type pausedNetwork struct {
+	network *net.IPNet
+	mac     string
+	until   time.Time
+}
+
+func newPauses() *pauses {
+	return &pauses{
+		mutex:    &sync.Mutex{},
+		clients:  map[string]time.Time{},
+		networks: map[string]pausedNetwork{},
+	}
+}
+
+// Pause filtering for the duration, for everyone if client is empty, otherwise for the client's IP address, CIDR range,
+// MAC address or group
+func (h *RequestHandler) Pause(duration time.Duration, client string) error {
+	if duration <= 0 {
+		return fmt.Errorf("invalid duration %s", duration)
+	}
+
+	p := h.pauses
+	until := time.Now().Add(duration)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if client == "" {
+		p.all = until
+		log.Infof("Blocking paused until %s", until.Format("15:04:05"))
+		return nil
+	}
+
+	if ip := net.ParseIP(client); ip != nil {
+		p.clients[ip.String()] = until
+	} else if h.isGroup(client) {
+		p.clients[client] = until
+	} else {
+		network, mac, err := shared.ParseClient(client)
+		if err != nil {
+			return fmt.Errorf("%s is not a client group, IP address, CIDR range or MAC address", client)
+		}
+
+		paused := pausedNetwork{network: network, until: until}
+		if mac != nil {
+			paused.mac = mac.String()
+		}
+		p.networks[client] = paused
+	}
+
+	log.Infof("Blocking paused for %s until %s", client, until.Format("15:04:05"))
+	return nil
+}
+
+// Resume filtering for everyone if client is empty, otherwise for a client that was paused separately
+func (h *RequestHandler) Resume(client string) {
+	p := h.pauses
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if client == "" {
+		p.all = time.Time{}
+		p.clients = map[string]time.Time{}
+		p.networks = map[string]pausedNetwork{}
+		log.Info("Blocking resumed")
+		return
+	}
+
+	if ip := net.ParseIP(client); ip != nil {
+		client = ip.String()
+	}
+	delete(p.clients, client)
+	delete(p.networks, client)
+	log.Infof("Blocking resumed for %s", client)
+}
+
+// How much longer filtering is paused for everyone, zero if it's not
+func (h *RequestHandler) PausedFor() time.Duration {
+	p := h.pauses
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if left := time.Until(p.all); left > 0 {
+		return left
+	}
+	return 0
+}
+
+func (h *RequestHandler) isGroup(name string) bool {
+	for _, g := range h.groups {
+		if g.policy.group == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if filtering is paused for the request
+func (h *RequestHandler) isPaused(info requestInfo) bool {
+	p := h.pauses
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if info.now.Before(p.all) {
+		return true
+	}
+
+	if len(p.clients) == 0 && len(p.networks) == 0 {
+		return false
+	}
+
+	if info.ip != nil && info.now.Before(p.clients[info.ip.String()]) {
+		return true
+	}
+
+	if group := info.group(); group != "" && info.now.Before(p.clients[group]) {
+		return true
+	}
+
+	for key, paused := range p.networks {
+		if !info.now.Before(paused.until) {
+			delete(p.networks, key)
+			continue
+		}
+
+		if info.ip == nil {
+			continue
+		}
+
+		if paused.network != nil && paused.network.Contains(info.ip) {
+			return true
+		}
+
+		if paused.mac != "" && h.neighbours.lookup(info.ip) == paused.mac {
+			return true
+		}
+	}
+
+	return false
+}
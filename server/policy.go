@@ -0,0 +1,185 @@
+package server
+
+import (
+	"github.com/lietu/better-dns/client"
+	"github.com/miekg/dns"
+	"net"
+)
+
+// Returned instead of a response when the request should not be answered at all
+var dropResponse = new(dns.Msg)
+
+func (f *Filter) addIPRule(network *net.IPNet, r *rule) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.blockedIPs.insert(network, r)
+	countEntry(f.listEntries, r.entry.Src)
+}
+
+func (f *Filter) addNsdnameRule(name string, r *rule, self bool, subdomains bool) {
+	f.addRule(f.blockedNsdnames, f.listEntries, name, r, self, subdomains)
+}
+
+// Get the address from an A or AAAA record
+func answerIP(rr dns.RR) net.IP {
+	switch a := rr.(type) {
+	case *dns.A:
+		return a.A
+	case *dns.AAAA:
+		return a.AAAA
+	}
+
+	return nil
+}
+
+// Check the name servers of the queried domain against the rpz-nsdname rules, returns the rule and the name server
+// name it is for
+func (f *Filter) checkNameServers(req *dns.Msg, info requestInfo, dnsServers []string) (*rule, string) {
+	if f.blockedNsdnames.isEmpty() {
+		return nil, ""
+	}
+
+	applies := f.applies(req, info)
+	for _, ns := range nameServers(req.Question[0].Name, dnsServers) {
+		if r, matched := f.blockedNsdnames.match(ns, applies); r != nil {
+			if r.action == actionPassthru {
+				return nil, ""
+			}
+			return r, matched
+		}
+	}
+
+	return nil, ""
+}
+
+// Find the names of the authoritative name servers for name, walking up to the zone apex if necessary
+func nameServers(name string, dnsServers []string) []string {
+	for name != "." {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeNS)
+
+		res := resolve(req, dnsServers)
+		if res == nil {
+			return nil
+		}
+
+		servers := []string{}
+		for _, rr := range res.Answer {
+			if ns, ok := rr.(*dns.NS); ok {
+				servers = append(servers, ns.Ns)
+			}
+		}
+
+		if len(servers) > 0 {
+			return servers
+		}
+
+		// Not the zone apex, the SOA in the authority section tells which zone the name belongs to
+		next := ""
+		for _, rr := range res.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				next = soa.Hdr.Name
+			}
+		}
+
+		if next == "" || next == name {
+			return nil
+		}
+		name = next
+	}
+
+	return nil
+}
+
+// Resolve a request from cache or the DNS servers, for internal lookups
+func resolve(req *dns.Msg, dnsServers []string) *dns.Msg {
+	if cached := getCache(req, dnsServers); cached != nil {
+		return cached
+	}
+
+	res := client.Query(req, dnsServers)
+	if res != nil {
+		setCache(req, res, dnsServers)
+	}
+
+	return res
+}
+
+// Build the response for a request matching rule, nil means it should be resolved normally
+func newPolicyResponse(req *dns.Msg, r *rule, mode *blockingMode, dnsServers []string) *dns.Msg {
+	switch r.action {
+	case actionNxdomain:
+		return newNegativeResponse(req, dns.RcodeNameError, mode.ttl)
+	case actionNodata:
+		return newNegativeResponse(req, dns.RcodeSuccess, mode.ttl)
+	case actionDrop:
+		return dropResponse
+	case actionTcpOnly:
+		res := new(dns.Msg)
+		res.SetReply(req)
+		res.Truncated = true
+		return res
+	case actionLocalData:
+		return newLocalDataResponse(req, r.localData, dnsServers)
+	case actionPassthru:
+		return nil
+	}
+
+	return newFilteredResponse(req, mode)
+}
+
+// Time to live for rewritten names
+const rewriteTTL = 300
+
+// Respond with a CNAME to target, along with the records for target resolved like a normal request would be
+func newRewriteResponse(req *dns.Msg, target string, dnsServers []string) *dns.Msg {
+	question := req.Question[0]
+	cname := &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: question.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: rewriteTTL},
+		Target: dns.Fqdn(target),
+	}
+
+	return newLocalDataResponse(req, []dns.RR{cname}, dnsServers)
+}
+
+// Respond with the given records, any CNAME target is resolved like a normal request would be
+func newLocalDataResponse(req *dns.Msg, localData []dns.RR, dnsServers []string) *dns.Msg {
+	question := req.Question[0]
+
+	res := new(dns.Msg)
+	res.SetReply(req)
+	res.RecursionAvailable = true
+
+	for _, rr := range localData {
+		cname, isCname := rr.(*dns.CNAME)
+		if !isCname {
+			continue
+		}
+
+		rr = dns.Copy(rr)
+		rr.Header().Name = question.Name
+		res.Answer = append(res.Answer, rr)
+
+		if question.Qtype != dns.TypeCNAME {
+			target := new(dns.Msg)
+			target.SetQuestion(cname.Target, question.Qtype)
+			if resolved := resolve(target, dnsServers); resolved != nil {
+				res.Answer = append(res.Answer, resolved.Answer...)
+			}
+		}
+
+		// There can only be one CNAME, and nothing else with it
+		return res
+	}
+
+	for _, rr := range localData {
+		if rr.Header().Rrtype == question.Qtype {
+			rr = dns.Copy(rr)
+			rr.Header().Name = question.Name
+			res.Answer = append(res.Answer, rr)
+		}
+	}
+
+	return res
+}
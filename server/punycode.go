@@ -0,0 +1,130 @@
+package server
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+)
+
+// Punycode parameters from RFC 3492
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+	// Limit for the intermediate values, well below overflowing on 32-bit platforms
+	punyMaxInt = 1<<31 - 1
+)
+
+var errInvalidPunycode = errors.New("invalid punycode")
+
+// Decode a "xn--" label of an internationalized domain name, labels without the prefix are returned as they are
+func decodeIDNLabel(label string) (string, error) {
+	if len(label) < 4 || !strings.EqualFold(label[:4], "xn--") {
+		return label, nil
+	}
+	return decodePunycode(strings.ToLower(label[4:]))
+}
+
+// Decode a punycode string as described in RFC 3492
+func decodePunycode(encoded string) (string, error) {
+	output := []rune{}
+	pos := 0
+
+	// Everything before the last delimiter is taken as is
+	if d := strings.LastIndexByte(encoded, '-'); d >= 0 {
+		for _, c := range encoded[:d] {
+			if c >= 0x80 {
+				return "", errInvalidPunycode
+			}
+			output = append(output, c)
+		}
+		pos = d + 1
+	}
+
+	n := punyInitialN
+	bias := punyInitialBias
+	i := 0
+	for pos < len(encoded) {
+		oldI := i
+		w := 1
+		for k := punyBase; ; k += punyBase {
+			if pos == len(encoded) {
+				return "", errInvalidPunycode
+			}
+
+			digit, ok := punyDigit(encoded[pos])
+			pos++
+			if !ok || digit > (punyMaxInt-i)/w {
+				return "", errInvalidPunycode
+			}
+			i += digit * w
+
+			t := k - bias
+			if t < punyTMin {
+				t = punyTMin
+			} else if t > punyTMax {
+				t = punyTMax
+			}
+
+			if digit < t {
+				break
+			}
+
+			if w > punyMaxInt/(punyBase-t) {
+				return "", errInvalidPunycode
+			}
+			w *= punyBase - t
+		}
+
+		length := len(output) + 1
+		bias = punyAdapt(i-oldI, length, oldI == 0)
+
+		if i/length > punyMaxInt-n {
+			return "", errInvalidPunycode
+		}
+		n += i / length
+		i %= length
+
+		if n > unicode.MaxRune {
+			return "", errInvalidPunycode
+		}
+
+		output = append(output, 0)
+		copy(output[i+1:], output[i:])
+		output[i] = rune(n)
+		i++
+	}
+
+	return string(output), nil
+}
+
+func punyDigit(c byte) (int, bool) {
+	switch {
+	case c >= 'a' && c <= 'z':
+		return int(c - 'a'), true
+	case c >= '0' && c <= '9':
+		return int(c-'0') + 26, true
+	}
+	return 0, false
+}
+
+func punyAdapt(delta int, numPoints int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+
+	delta += delta / numPoints
+	k := 0
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
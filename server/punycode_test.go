@@ -0,0 +1,39 @@
+package server
+
+import "testing"
+
+func TestDecodeIDNLabel(t *testing.T) {
+	tests := []struct {
+		label    string
+		expected string
+		valid    bool
+	}{
+		{"example", "example", true},
+		{"xn", "xn", true},
+		{"xn--pple-43d", "аpple", true},
+		{"XN--MNCHEN-3YA", "münchen", true},
+		{"xn--bcher-kva", "bücher", true},
+		{"xn--tda", "ü", true},
+		{"xn--wgv71a119e", "日本語", true},
+		{"xn--80ak6aa92e", "аррӏе", true},
+		{"xn--paypal-lgin-ynj", "paypal-lоgin", true},
+		// Sample (A) from RFC 3492
+		{"xn--egbpdaj6bu4bxfgehfvwxn", "ليهمابتكلموشعربي؟", true},
+		{"xn--", "", true},
+		{"xn--abc-", "abc", true},
+		{"xn--pple-43", "", false},
+		{"xn--pple-4!d", "", false},
+		{"xn--ü-abc", "", false},
+		{"xn--99999999999", "", false},
+	}
+
+	for _, test := range tests {
+		decoded, err := decodeIDNLabel(test.label)
+		if test.valid && (err != nil || decoded != test.expected) {
+			t.Errorf("%s: got %q (%v), expected %q", test.label, decoded, err, test.expected)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected an error, got %q", test.label, decoded)
+		}
+	}
+}
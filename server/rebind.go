@@ -0,0 +1,128 @@
+package server
+
+import (
+	"github.com/lietu/better-dns/shared"
+	"github.com/lietu/better-dns/stats"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+)
+
+// Addresses on the local network or the machine itself, public names resolving to these can be used by web pages to
+// reach local services
+var privateNetworks = []*net.IPNet{}
+
+// Domains that are only used on local networks
+var localDomains = []string{"localhost.", "local.", "lan.", "home.", "home.arpa.", "internal."}
+
+func init() {
+	for _, network := range []string{
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"::/128",
+		"::1/128",
+		"fc00::/7",
+		"fe80::/10",
+	} {
+		_, n, err := net.ParseCIDR(network)
+		if err != nil {
+			panic(err)
+		}
+		privateNetworks = append(privateNetworks, n)
+	}
+}
+
+// Removes or blocks private addresses in the answers for public names
+type rebindProtection struct {
+	strip bool
+	// Domains allowed to resolve to private addresses
+	allowed map[string]bool
+}
+
+func newRebindProtection(c *shared.Config) *rebindProtection {
+	if c.RebindProtection == "off" {
+		return nil
+	}
+
+	r := &rebindProtection{
+		strip:   c.RebindProtection == "strip",
+		allowed: map[string]bool{},
+	}
+
+	for _, domain := range localDomains {
+		r.allowed[domain] = true
+	}
+	for _, domain := range c.RebindAllowlist {
+		r.allowed[normalizeName(domain)] = true
+	}
+
+	return r
+}
+
+// Get the private network ip is in, nil if it's a public address
+func privateNetworkFor(ip net.IP) *net.IPNet {
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return n
+		}
+	}
+	return nil
+}
+
+// Check if name is allowed to resolve to private addresses
+func (r *rebindProtection) isAllowed(name string) bool {
+	name = normalizeName(name)
+
+	// Single label names can only be local
+	if strings.Count(name, ".") < 2 {
+		return true
+	}
+
+	for name != "" {
+		if r.allowed[name] {
+			return true
+		}
+
+		dot := strings.IndexByte(name, '.')
+		name = name[dot+1:]
+	}
+
+	return false
+}
+
+// Check the response for private addresses, returns the response to use instead if there were any, and whether the
+// whole response was blocked
+func (r *rebindProtection) check(req *dns.Msg, res *dns.Msg, info requestInfo) (*dns.Msg, bool) {
+	if r.isAllowed(req.Question[0].Name) {
+		return nil, false
+	}
+
+	entry := &shared.BlockEntry{Src: "rebind protection"}
+	answers := make([]dns.RR, 0, len(res.Answer))
+	for _, rr := range res.Answer {
+		if ip := answerIP(rr); ip != nil {
+			if network := privateNetworkFor(ip); network != nil {
+				go stats.ReportIPBlocked(req, ip, network, entry, r.strip, info.group())
+				if !r.strip {
+					return newFilteredResponse(req, info.policy.blocking), true
+				}
+				continue
+			}
+		}
+
+		answers = append(answers, rr)
+	}
+
+	if len(answers) == len(res.Answer) {
+		return nil, false
+	}
+
+	stripped := res.Copy()
+	stripped.Answer = answers
+	return stripped, false
+}
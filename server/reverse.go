@@ -0,0 +1,74 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Time to live for answers to private reverse lookups
+const privateReverseTTL = 300
+
+// Reverse zones for private, loopback, link-local and other special-use addresses that public DNS servers can't know
+// anything about, from RFC 6303 and RFC 6761
+var privateReverseZones = map[string]bool{}
+
+func init() {
+	zones := []string{
+		// RFC 1918
+		"10.in-addr.arpa.",
+		"168.192.in-addr.arpa.",
+		// "This" network, loopback and link-local
+		"0.in-addr.arpa.",
+		"127.in-addr.arpa.",
+		"254.169.in-addr.arpa.",
+		// Documentation ranges and the broadcast address
+		"2.0.192.in-addr.arpa.",
+		"100.51.198.in-addr.arpa.",
+		"113.0.203.in-addr.arpa.",
+		"255.255.255.255.in-addr.arpa.",
+		// Unspecified and loopback addresses
+		strings.Repeat("0.", 32) + "ip6.arpa.",
+		"1." + strings.Repeat("0.", 31) + "ip6.arpa.",
+		// Unique local addresses
+		"c.f.ip6.arpa.",
+		"d.f.ip6.arpa.",
+		// Link-local
+		"8.e.f.ip6.arpa.",
+		"9.e.f.ip6.arpa.",
+		"a.e.f.ip6.arpa.",
+		"b.e.f.ip6.arpa.",
+		// Documentation
+		"8.b.d.0.1.0.0.2.ip6.arpa.",
+	}
+
+	// 172.16.0.0/12 and the 100.64.0.0/10 shared address space used by carrier-grade NAT
+	for i := 16; i < 32; i++ {
+		zones = append(zones, fmt.Sprintf("%d.172.in-addr.arpa.", i))
+	}
+	for i := 64; i < 128; i++ {
+		zones = append(zones, fmt.Sprintf("%d.100.in-addr.arpa.", i))
+	}
+
+	for _, zone := range zones {
+		privateReverseZones[zone] = true
+	}
+}
+
+// Check if name is in one of the private reverse zones
+func isPrivateReverse(name string) bool {
+	name = normalizeName(name)
+	if !strings.HasSuffix(name, ".arpa.") {
+		return false
+	}
+
+	for name != "" {
+		if privateReverseZones[name] {
+			return true
+		}
+
+		dot := strings.IndexByte(name, '.')
+		name = name[dot+1:]
+	}
+
+	return false
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"github.com/lietu/better-dns/shared"
+	"github.com/lietu/better-dns/stats"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"strings"
+)
+
+var rewriteEntry = &shared.BlockEntry{Src: "rewrites"}
+
+// How many rewritten CNAMEs are followed before giving up, in case they loop
+const maxRewriteChain = 8
+
+// Build the rewrites from the configuration, records of the same name and type are answered together
+func newRewrites(rewrites []shared.Rewrite) *domainTrie {
+	type key struct {
+		name  string
+		rtype string
+	}
+
+	rules := map[key]*rule{}
+	order := []key{}
+	for _, rw := range rewrites {
+		k := key{name: strings.ToLower(rw.Name), rtype: strings.ToUpper(rw.Type)}
+		r, ok := rules[k]
+		if !ok {
+			r = newRewriteRule(k.rtype)
+			rules[k] = r
+			order = append(order, k)
+		}
+
+		if rw.Value == "" || r.action != actionLocalData {
+			continue
+		}
+
+		if rr := newRewriteRecord(k.rtype, rw.Value); rr != nil {
+			r.localData = append(r.localData, rr)
+		} else {
+			log.Errorf("Ignoring invalid %s rewrite value %s for %s", rw.Type, rw.Value, rw.Name)
+		}
+	}
+
+	// A name rewritten to an address of only one family gets an empty answer for the other one, instead of the real
+	// address from upstream
+	otherFamily := map[string]string{"A": "AAAA", "AAAA": "A"}
+	for _, k := range order {
+		other := key{name: k.name, rtype: otherFamily[k.rtype]}
+		if _, ok := rules[other]; other.rtype != "" && !ok {
+			r := newRewriteRule(other.rtype)
+			r.action = actionNodata
+			rules[other] = r
+			order = append(order, other)
+		}
+	}
+
+	t := newDomainTrie()
+	for _, k := range order {
+		r := rules[k]
+		// Types without any records get an empty answer
+		if r.action == actionLocalData && len(r.localData) == 0 {
+			r.action = actionNodata
+		}
+
+		if strings.HasPrefix(k.name, "*.") {
+			t.add(k.name[2:], r, false, true)
+		} else {
+			t.add(k.name, r, true, false)
+		}
+	}
+	t.freeze(nil)
+
+	return t
+}
+
+func newRewriteRule(rtype string) *rule {
+	r := &rule{entry: rewriteEntry, action: actionLocalData, important: true}
+	switch rtype {
+	case "NXDOMAIN":
+		r.action = actionNxdomain
+	case "CNAME":
+		// Answers every type
+	default:
+		r.dnsTypes = &dnsTypeMatcher{include: []uint16{dns.StringToType[rtype]}}
+	}
+
+	return r
+}
+
+// Make the record for a rewrite, the name is filled in when answering
+func newRewriteRecord(rtype string, value string) dns.RR {
+	hdr := dns.RR_Header{Rrtype: dns.StringToType[rtype], Class: dns.ClassINET, Ttl: rewriteTTL}
+	switch rtype {
+	case "A":
+		if ip := net.ParseIP(value).To4(); ip != nil {
+			return &dns.A{Hdr: hdr, A: ip}
+		}
+	case "AAAA":
+		if ip := net.ParseIP(value); ip != nil {
+			return &dns.AAAA{Hdr: hdr, AAAA: ip}
+		}
+	case "CNAME":
+		return &dns.CNAME{Hdr: hdr, Target: dns.Fqdn(strings.ToLower(value))}
+	case "TXT":
+		return &dns.TXT{Hdr: hdr, Txt: []string{value}}
+	}
+
+	return nil
+}
+
+// Answer the request from the rewrites, following rewritten CNAMEs and resolving the final target like any other
+// request. Returns false if there is no rewrite for the name.
+func (h *RequestHandler) getRewritten(req *dns.Msg, info requestInfo) (*dns.Msg, bool) {
+	question := req.Question[0]
+	applies := func(r *rule) bool {
+		return r.appliesTo(question.Qtype, info)
+	}
+
+	r, _ := h.rewrites.match(question.Name, applies)
+	if r == nil {
+		return nil, false
+	}
+
+	res := new(dns.Msg)
+	res.SetReply(req)
+	res.RecursionAvailable = true
+
+	name := question.Name
+	for i := 0; i < maxRewriteChain; i++ {
+		switch r.action {
+		case actionNxdomain:
+			res.Rcode = dns.RcodeNameError
+			fallthrough
+		case actionNodata:
+			negative := newNegativeResponse(req, dns.RcodeSuccess, info.policy.blocking.ttl)
+			res.Ns = negative.Ns
+			go stats.ReportRewritten(req, dns.RcodeToString[res.Rcode], "rewrites", info.group())
+			return res, true
+		}
+
+		cname, isCname := r.localData[0].(*dns.CNAME)
+		if !isCname {
+			for _, rr := range r.localData {
+				rr = dns.Copy(rr)
+				rr.Header().Name = name
+				res.Answer = append(res.Answer, rr)
+			}
+			go stats.ReportRewritten(req, stats.AnswerResult(res.Answer[len(res.Answer)-1]), "rewrites", info.group())
+			return res, true
+		}
+
+		rr := dns.Copy(cname)
+		rr.Header().Name = name
+		res.Answer = append(res.Answer, rr)
+		name = cname.Target
+
+		if question.Qtype == dns.TypeCNAME {
+			go stats.ReportRewritten(req, name, "rewrites", info.group())
+			return res, true
+		}
+
+		r, _ = h.rewrites.match(name, applies)
+		if r == nil {
+			go stats.ReportRewritten(req, name, "rewrites", info.group())
+
+			// Not rewritten any further, so resolved like the client asked for it
+			target := new(dns.Msg)
+			target.SetQuestion(name, question.Qtype)
+			resolved := h.getResult(target, info)
+			if resolved == nil || resolved == dropResponse {
+				return resolved, true
+			}
+
+			res.Rcode = resolved.Rcode
+			res.Answer = append(res.Answer, resolved.Answer...)
+			res.Ns = resolved.Ns
+			return res, true
+		}
+	}
+
+	log.Errorf("Too many rewritten CNAMEs for %s, rewrites might be looping", question.Name)
+	return nil, true
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/lietu/better-dns/shared"
+	"github.com/miekg/dns"
+)
+
+func TestRewriteTypes(t *testing.T) {
+	h := &RequestHandler{rewrites: newRewrites([]shared.Rewrite{
+		{Name: "nas.lan", Type: "A", Value: "192.168.1.10"},
+		{Name: "v6.lan", Type: "AAAA", Value: "fd00::10"},
+		{Name: "both.lan", Type: "A", Value: "192.168.1.11"},
+		{Name: "both.lan", Type: "AAAA", Value: "fd00::11"},
+		{Name: "*.wild.lan", Type: "A", Value: "192.168.1.12"},
+		{Name: "txt.lan", Type: "TXT", Value: "hello"},
+		{Name: "gone.lan", Type: "NXDOMAIN"},
+	})}
+	info := requestInfo{policy: &clientPolicy{blocking: newBlockingMode(shared.BlockingConfig{})}}
+
+	tests := []struct {
+		name      string
+		qtype     uint16
+		rewritten bool
+		rcode     int
+		answers   int
+	}{
+		{"nas.lan.", dns.TypeA, true, dns.RcodeSuccess, 1},
+		{"nas.lan.", dns.TypeAAAA, true, dns.RcodeSuccess, 0},
+		{"nas.lan.", dns.TypeMX, false, 0, 0},
+		{"v6.lan.", dns.TypeAAAA, true, dns.RcodeSuccess, 1},
+		{"v6.lan.", dns.TypeA, true, dns.RcodeSuccess, 0},
+		{"both.lan.", dns.TypeA, true, dns.RcodeSuccess, 1},
+		{"both.lan.", dns.TypeAAAA, true, dns.RcodeSuccess, 1},
+		{"host.wild.lan.", dns.TypeA, true, dns.RcodeSuccess, 1},
+		{"host.wild.lan.", dns.TypeAAAA, true, dns.RcodeSuccess, 0},
+		{"wild.lan.", dns.TypeAAAA, false, 0, 0},
+		{"txt.lan.", dns.TypeTXT, true, dns.RcodeSuccess, 1},
+		{"txt.lan.", dns.TypeA, false, 0, 0},
+		{"gone.lan.", dns.TypeAAAA, true, dns.RcodeNameError, 0},
+		{"other.lan.", dns.TypeA, false, 0, 0},
+	}
+
+	for _, test := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(test.name, test.qtype)
+
+		res, rewritten := h.getRewritten(req, info)
+		if rewritten != test.rewritten {
+			t.Errorf("%s %s: expected rewritten %v, got %v", test.name, dns.TypeToString[test.qtype], test.rewritten, rewritten)
+			continue
+		}
+		if !rewritten {
+			continue
+		}
+		if res.Rcode != test.rcode || len(res.Answer) != test.answers {
+			t.Errorf("%s %s: expected %s with %d answers, got %s with %d", test.name, dns.TypeToString[test.qtype], dns.RcodeToString[test.rcode], test.answers, dns.RcodeToString[res.Rcode], len(res.Answer))
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"fmt"
+	"github.com/lietu/better-dns/shared"
+	"github.com/lietu/better-dns/stats"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Policy for a single owner name in a Response Policy Zone
+type rpzPolicy struct {
+	trigger string
+	// The first record of the policy, for explaining
+	text      string
+	action    policyAction
+	localData []dns.RR
+}
+
+// Parse a Response Policy Zone
+func (f *Filter) readRPZ(list shared.ListConfig, body io.Reader) {
+	start := time.Now()
+	listURL := list.URL
+
+	zone := ""
+	policies := map[string]*rpzPolicy{}
+	owners := []string{}
+	skipped := map[string]int64{}
+
+	origin := ""
+	if list.Zone != "" {
+		origin = dns.Fqdn(list.Zone)
+	}
+
+	zp := dns.NewZoneParser(body, origin, listURL)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		owner := strings.ToLower(rr.Header().Name)
+
+		if soa, ok := rr.(*dns.SOA); ok && zone == "" {
+			zone = strings.ToLower(soa.Hdr.Name)
+			continue
+		}
+
+		if zone == "" {
+			log.Errorf("Error while processing RPZ %s: no SOA record before policies", listURL)
+			return
+		}
+
+		if owner == zone || !dns.IsSubDomain(zone, owner) {
+			// Zone apex NS records and such, nothing to do with policies
+			continue
+		}
+
+		p, ok := policies[owner]
+		if !ok {
+			p = &rpzPolicy{trigger: strings.TrimSuffix(owner, "."+zone), text: rr.String()}
+			policies[owner] = p
+			owners = append(owners, owner)
+		}
+
+		if cname, ok := rr.(*dns.CNAME); ok {
+			target := strings.ToLower(cname.Target)
+			switch {
+			case target == ".":
+				p.action = actionNxdomain
+			case target == "*.":
+				p.action = actionNodata
+			case target == "rpz-passthru." || target == p.trigger+".":
+				p.action = actionPassthru
+			case target == "rpz-drop.":
+				p.action = actionDrop
+			case target == "rpz-tcp-only.":
+				p.action = actionTcpOnly
+			default:
+				p.action = actionLocalData
+				p.localData = append(p.localData, rr)
+			}
+		} else {
+			p.action = actionLocalData
+			p.localData = append(p.localData, rr)
+		}
+	}
+
+	if err := zp.Err(); err != nil {
+		log.Errorf("Error while processing RPZ %s: %s", listURL, err)
+	}
+
+	zoneName := strings.TrimSuffix(zone, ".")
+	for _, owner := range owners {
+		if err := f.addRPZPolicy(policies[owner], listURL, zoneName); err != nil {
+			log.Debugf("Skipping policy %s: %s", owner, err)
+			skipped[err.Error()]++
+		}
+	}
+
+	if len(skipped) > 0 {
+		f.reportSkipped(listURL, skipped)
+	}
+
+	log.Debugf("✔ Parsed %s RPZ in %s", listURL, stats.CleanDuration(time.Since(start)))
+}
+
+func (f *Filter) addRPZPolicy(p *rpzPolicy, list string, zone string) error {
+	entry := &shared.BlockEntry{Src: list, Zone: zone}
+	if f.explain {
+		entry.Rule = p.text
+	}
+
+	r := &rule{
+		entry:     entry,
+		action:    p.action,
+		localData: p.localData,
+	}
+
+	trigger := p.trigger
+	self := true
+	subdomains := false
+	if strings.HasPrefix(trigger, "*.") {
+		trigger = trigger[2:]
+		self = false
+		subdomains = true
+	}
+
+	switch {
+	case strings.HasSuffix(trigger, ".rpz-ip"):
+		network, err := parseRPZIP(strings.TrimSuffix(trigger, ".rpz-ip"))
+		if err != nil {
+			return err
+		}
+		f.addIPRule(network, r)
+	case strings.HasSuffix(trigger, ".rpz-nsdname"):
+		f.addNsdnameRule(strings.TrimSuffix(trigger, ".rpz-nsdname"), r, self, subdomains)
+	case strings.HasSuffix(trigger, ".rpz-client-ip"):
+		return unsupportedRule("rpz-client-ip trigger")
+	case strings.HasSuffix(trigger, ".rpz-nsip"):
+		return unsupportedRule("rpz-nsip trigger")
+	case p.action == actionPassthru:
+		f.addRule(f.allowedEntries, f.allowListEntries, trigger, r, self, subdomains)
+	default:
+		f.addRule(f.blockedEntries, f.listEntries, trigger, r, self, subdomains)
+	}
+
+	return nil
+}
+
+// Parse rpz-ip trigger labels, e.g. "24.0.2.0.192" for 192.0.2.0/24 or "128.1.zz.db8.2001" for 2001:db8::1/128
+func parseRPZIP(labels string) (*net.IPNet, error) {
+	parts := strings.Split(labels, ".")
+	invalid := unsupportedRule("invalid rpz-ip trigger")
+	if len(parts) < 2 {
+		return nil, invalid
+	}
+
+	prefix, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, invalid
+	}
+
+	address := parts[1:]
+	for i, j := 0, len(address)-1; i < j; i, j = i+1, j-1 {
+		address[i], address[j] = address[j], address[i]
+	}
+
+	var ip net.IP
+	bits := 128
+	if len(address) == 4 && !strings.Contains(labels, "zz") {
+		ip = net.ParseIP(strings.Join(address, ".")).To4()
+		bits = 32
+	} else {
+		// "zz" stands for "::", which can also be at either end as in 2001:db8::
+		text := strings.Replace(":"+strings.Join(address, ":")+":", ":zz:", "::", 1)
+		if !strings.HasPrefix(text, "::") {
+			text = text[1:]
+		}
+		if !strings.HasSuffix(text, "::") {
+			text = text[:len(text)-1]
+		}
+		ip = net.ParseIP(text)
+	}
+
+	if ip == nil || prefix < 0 || prefix > bits {
+		return nil, invalid
+	}
+
+	network := &net.IPNet{IP: ip.Mask(net.CIDRMask(prefix, bits)), Mask: net.CIDRMask(prefix, bits)}
+	if !network.IP.Equal(ip) {
+		return nil, fmt.Errorf("invalid rpz-ip trigger, address %s has bits outside /%d", ip, prefix)
+	}
+
+	return network, nil
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/lietu/better-dns/shared"
+)
+
+func TestParseRPZIP(t *testing.T) {
+	tests := []struct {
+		labels   string
+		expected string
+	}{
+		{"32.1.2.0.192", "192.0.2.1/32"},
+		{"24.0.2.0.192", "192.0.2.0/24"},
+		{"8.0.0.0.10", "10.0.0.0/8"},
+		{"0.0.0.0.0", "0.0.0.0/0"},
+		{"128.1.zz.db8.2001", "2001:db8::1/128"},
+		{"128.8.7.6.5.4.3.2.1", "1:2:3:4:5:6:7:8/128"},
+		{"48.zz.db8.2001", "2001:db8::/48"},
+		{"128.1.zz", "::1/128"},
+		{"24.1.2.0.192", ""},
+		{"33.1.2.0.192", ""},
+		{"-1.1.2.0.192", ""},
+		{"x.1.2.0.192", ""},
+		{"24.2.0.192", ""},
+		{"129.1.zz.db8.2001", ""},
+		{"64.1.zz.db8.2001", ""},
+		{"24", ""},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		network, err := parseRPZIP(test.labels)
+		switch {
+		case test.expected == "" && err == nil:
+			t.Errorf("%q: expected an error, got %s", test.labels, network)
+		case test.expected != "" && err != nil:
+			t.Errorf("%q: expected %s, got %s", test.labels, test.expected, err)
+		case test.expected != "" && network.String() != test.expected:
+			t.Errorf("%q: expected %s, got %s", test.labels, test.expected, network)
+		}
+	}
+}
+
+func TestReadRPZ(t *testing.T) {
+	zone := strings.Join([]string{
+		"$TTL 300",
+		"@ SOA localhost. root.localhost. 1 3600 600 86400 300",
+		"  NS localhost.",
+		"nx.example.com CNAME .",
+		"nodata.example.com CNAME *.",
+		"*.wild.example.com CNAME .",
+		"pass.example.com CNAME rpz-passthru.",
+		"self.example.com CNAME self.example.com.",
+		"drop.example.com CNAME rpz-drop.",
+		"tcp.example.com CNAME rpz-tcp-only.",
+		"local.example.com A 10.0.0.1",
+		"local.example.com A 10.0.0.2",
+		"walled.example.com CNAME walled-garden.example.net.",
+		"24.0.2.0.192.rpz-ip CNAME .",
+		"128.1.zz.db8.2001.rpz-ip CNAME rpz-drop.",
+		"24.1.2.0.192.rpz-ip CNAME .",
+		"ns.evil.example.rpz-nsdname CNAME .",
+		"32.1.0.0.127.rpz-client-ip CNAME .",
+	}, "\n")
+
+	f := newFilter()
+	f.readRPZ(shared.ListConfig{URL: "zone.rpz", Zone: "rpz.example"}, strings.NewReader(zone))
+	f.freeze()
+
+	always := func(r *rule) bool { return true }
+	names := []struct {
+		name      string
+		action    policyAction
+		localData int
+	}{
+		{"nx.example.com", actionNxdomain, 0},
+		{"nodata.example.com", actionNodata, 0},
+		{"sub.wild.example.com", actionNxdomain, 0},
+		{"drop.example.com", actionDrop, 0},
+		{"tcp.example.com", actionTcpOnly, 0},
+		{"local.example.com", actionLocalData, 2},
+		{"walled.example.com", actionLocalData, 1},
+	}
+
+	for _, test := range names {
+		r, _ := f.blockedEntries.match(test.name, always)
+		if r == nil {
+			t.Errorf("%s should be blocked", test.name)
+			continue
+		}
+		if r.action != test.action || len(r.localData) != test.localData {
+			t.Errorf("%s: got action %d with %d records, expected %d with %d", test.name, r.action, len(r.localData), test.action, test.localData)
+		}
+		if r.entry.Src != "zone.rpz" || r.entry.Zone != "rpz.example" {
+			t.Errorf("%s: got entry %+v", test.name, r.entry)
+		}
+	}
+
+	if r, _ := f.blockedEntries.match("wild.example.com", always); r != nil {
+		t.Errorf("wild.example.com should only have its subdomains blocked")
+	}
+
+	for _, name := range []string{"pass.example.com", "self.example.com"} {
+		if r, _ := f.allowedEntries.match(name, always); r == nil || r.action != actionPassthru {
+			t.Errorf("%s should be passed through", name)
+		}
+	}
+
+	ips := []struct {
+		ip      string
+		action  policyAction
+		blocked bool
+	}{
+		{"192.0.2.10", actionNxdomain, true},
+		{"192.0.3.10", actionNxdomain, false},
+		{"2001:db8::1", actionDrop, true},
+		{"2001:db8::2", actionDrop, false},
+	}
+
+	for _, test := range ips {
+		r, _ := f.blockedIPs.match(net.ParseIP(test.ip), always)
+		if (r != nil) != test.blocked || (r != nil && r.action != test.action) {
+			t.Errorf("%s: got %v, expected blocked %v with action %d", test.ip, r, test.blocked, test.action)
+		}
+	}
+
+	if r, _ := f.blockedNsdnames.match("ns.evil.example", always); r == nil || r.action != actionNxdomain {
+		t.Errorf("ns.evil.example should be blocked as a name server")
+	}
+
+	skipped := f.skippedListEntries["zone.rpz"]
+	if skipped != 2 {
+		t.Errorf("expected the invalid rpz-ip and the rpz-client-ip triggers to be skipped, got %d skipped", skipped)
+	}
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"github.com/lietu/better-dns/shared"
+	"github.com/miekg/dns"
+	"net"
+	"time"
+)
+
+// What to do with a request matching a rule
+type policyAction int
+
+const (
+	// The normal blocked response
+	actionBlock policyAction = iota
+	actionNxdomain
+	actionNodata
+	// Explicitly allowed, nothing else applies
+	actionPassthru
+	// Do not respond at all
+	actionDrop
+	// Force the client to retry over TCP
+	actionTcpOnly
+	// Respond with the rule's own records
+	actionLocalData
+)
+
+// Who is asking and how, some rules only apply to specific clients or transports
+type requestInfo struct {
+	ip     net.IP
+	tcp    bool
+	policy *clientPolicy
+	// When the request was made, for schedules
+	now time.Time
+}
+
+// A single block or allow rule from a list, the blacklist or the allowlist
+type rule struct {
+	entry  *shared.BlockEntry
+	action policyAction
+	// Records to respond with for actionLocalData
+	localData []dns.RR
+	// Important rules win over less important ones of the opposite kind, e.g. "$important" blocks over "@@" exceptions
+	important bool
+	// Restrictions from "$dnstype=" and "$client=" modifiers, nil when the rule applies to everything
+	dnsTypes *dnsTypeMatcher
+	clients  *clientMatcher
+	// Times when the rule is active, nil when it's always active
+	schedules []*schedule
+}
+
+type dnsTypeMatcher struct {
+	include []uint16
+	exclude []uint16
+}
+
+type clientMatcher struct {
+	include []*net.IPNet
+	exclude []*net.IPNet
+}
+
+// Name of the client's group, for stats
+func (info requestInfo) group() string {
+	if info.policy == nil {
+		return ""
+	}
+	return info.policy.group
+}
+
+func (r *rule) appliesTo(qtype uint16, info requestInfo) bool {
+	// Already using TCP, nothing to do
+	if r.action == actionTcpOnly && info.tcp {
+		return false
+	}
+
+	if r.dnsTypes != nil && !r.dnsTypes.matches(qtype) {
+		return false
+	}
+
+	if r.clients != nil && !r.clients.matches(info.ip) {
+		return false
+	}
+
+	if r.schedules != nil && !scheduleActive(r.schedules, info.now) {
+		return false
+	}
+
+	return true
+}
+
+func (m *dnsTypeMatcher) matches(qtype uint16) bool {
+	for _, t := range m.exclude {
+		if t == qtype {
+			return false
+		}
+	}
+
+	if len(m.include) == 0 {
+		return true
+	}
+
+	for _, t := range m.include {
+		if t == qtype {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *clientMatcher) matches(client net.IP) bool {
+	if client == nil {
+		// Can't tell who's asking, only rules for everyone apply
+		return false
+	}
+
+	for _, n := range m.exclude {
+		if n.Contains(client) {
+			return false
+		}
+	}
+
+	if len(m.include) == 0 {
+		return true
+	}
+
+	for _, n := range m.include {
+		if n.Contains(client) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"strings"
+)
+
+// The providers' own addresses that force safe search or restricted mode on
+const googleSafeSearch = "forcesafesearch.google.com."
+const bingSafeSearch = "strict.bing.com."
+const duckDuckGoSafeSearch = "safe.duckduckgo.com."
+const youtubeRestricted = "restrict.youtube.com."
+
+var safeSearchNames = map[string]string{
+	"bing.com.":                 bingSafeSearch,
+	"www.bing.com.":             bingSafeSearch,
+	"duckduckgo.com.":           duckDuckGoSafeSearch,
+	"www.duckduckgo.com.":       duckDuckGoSafeSearch,
+	"start.duckduckgo.com.":     duckDuckGoSafeSearch,
+	"youtube.com.":              youtubeRestricted,
+	"www.youtube.com.":          youtubeRestricted,
+	"m.youtube.com.":            youtubeRestricted,
+	"youtubei.googleapis.com.":  youtubeRestricted,
+	"youtube.googleapis.com.":   youtubeRestricted,
+	"www.youtube-nocookie.com.": youtubeRestricted,
+}
+
+// Get the safe search address to use instead of name, empty if there is none
+func safeSearchTarget(name string) string {
+	name = normalizeName(name)
+	if target, ok := safeSearchNames[name]; ok {
+		return target
+	}
+
+	// Google has a domain for most countries, e.g. google.fi and www.google.co.uk
+	name = strings.TrimPrefix(name, "www.")
+	if strings.HasPrefix(name, "google.") {
+		tld := strings.TrimPrefix(name, "google.")
+		if labels := strings.Count(tld, "."); labels == 1 || (labels == 2 && (strings.HasPrefix(tld, "co.") || strings.HasPrefix(tld, "com."))) {
+			return googleSafeSearch
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"github.com/lietu/better-dns/shared"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+// A weekly time range during which some items are enabled or disabled
+type schedule struct {
+	name     string
+	location *time.Location
+	// Empty for every day
+	days map[time.Weekday]bool
+	// Minutes since midnight, to is smaller than from when the range continues past midnight and the same as from for
+	// the whole day
+	from    int
+	to      int
+	disable bool
+}
+
+// The schedules for each list, blacklist pattern and client group that has any
+type schedules struct {
+	lists     map[string][]*schedule
+	blacklist map[string][]*schedule
+	groups    map[string][]*schedule
+}
+
+func newSchedules(c *shared.Config) *schedules {
+	s := &schedules{
+		lists:     map[string][]*schedule{},
+		blacklist: map[string][]*schedule{},
+		groups:    map[string][]*schedule{},
+	}
+
+	location, err := c.GetTimezone()
+	if err != nil {
+		log.Errorf("Invalid timezone %s, using local time: %s", c.Timezone, err)
+		location = time.Local
+	}
+
+	for _, sc := range c.Schedules {
+		sch := &schedule{
+			name:     sc.Name,
+			location: location,
+			days:     map[time.Weekday]bool{},
+			disable:  sc.Mode == shared.ScheduleDisable,
+		}
+
+		for _, day := range sc.Days {
+			if weekday, err := shared.ParseWeekday(day); err == nil {
+				sch.days[weekday] = true
+			}
+		}
+
+		sch.from, _ = shared.ParseTimeOfDay(sc.From)
+		sch.to, _ = shared.ParseTimeOfDay(sc.To)
+
+		for _, list := range sc.Lists {
+			s.lists[list] = append(s.lists[list], sch)
+		}
+		for _, pattern := range sc.Blacklist {
+			pattern = strings.ToLower(pattern)
+			s.blacklist[pattern] = append(s.blacklist[pattern], sch)
+		}
+		for _, group := range sc.Groups {
+			s.groups[group] = append(s.groups[group], sch)
+		}
+	}
+
+	return s
+}
+
+// Check if the time is within the schedule's range
+func (s *schedule) contains(t time.Time) bool {
+	t = t.In(s.location)
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+
+	if s.from == s.to {
+		return s.onDay(day)
+	}
+
+	if s.from < s.to {
+		return s.onDay(day) && minute >= s.from && minute < s.to
+	}
+
+	// Past midnight the range belongs to the day it started on
+	if minute >= s.from {
+		return s.onDay(day)
+	}
+	return minute < s.to && s.onDay((day+6)%7)
+}
+
+func (s *schedule) onDay(day time.Weekday) bool {
+	return len(s.days) == 0 || s.days[day]
+}
+
+// Check if an item with the given schedules is active at the time, items with "enable" schedules are only active
+// during them, and "disable" schedules turn items off during them
+func scheduleActive(items []*schedule, t time.Time) bool {
+	scheduled := false
+	enabled := false
+	for _, s := range items {
+		if s.disable {
+			if s.contains(t) {
+				return false
+			}
+		} else {
+			scheduled = true
+			if s.contains(t) {
+				enabled = true
+			}
+		}
+	}
+
+	return !scheduled || enabled
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lietu/better-dns/shared"
+)
+
+func TestScheduleContains(t *testing.T) {
+	tests := []struct {
+		from     string
+		to       string
+		days     []string
+		time     string
+		expected bool
+	}{
+		{"16:00", "20:00", nil, "2024-01-01 16:00", true},
+		{"16:00", "20:00", nil, "2024-01-01 20:00", false},
+		{"16:00", "20:00", nil, "2024-01-01 15:59", false},
+		{"22:00", "06:00", nil, "2024-01-01 23:00", true},
+		{"22:00", "06:00", nil, "2024-01-01 05:59", true},
+		{"22:00", "06:00", nil, "2024-01-01 12:00", false},
+		// Past midnight the range still belongs to the day it started on, 2024-01-01 is a Monday
+		{"22:00", "06:00", []string{"sun"}, "2024-01-01 05:00", true},
+		{"22:00", "06:00", []string{"sun"}, "2024-01-01 23:00", false},
+		{"", "", nil, "2024-01-01 00:00", true},
+		{"", "", nil, "2024-01-01 23:59", true},
+		{"00:00", "00:00", nil, "2024-01-01 12:00", true},
+		{"12:00", "12:00", nil, "2024-01-01 03:00", true},
+		{"", "", []string{"sun", "mon"}, "2024-01-01 12:00", true},
+		{"", "", []string{"sun", "mon"}, "2024-01-02 12:00", false},
+		{"22:00", "", nil, "2024-01-01 23:59", true},
+		{"22:00", "", nil, "2024-01-01 00:30", false},
+		{"", "06:00", nil, "2024-01-01 00:30", true},
+		{"", "06:00", nil, "2024-01-01 06:00", false},
+	}
+
+	for _, test := range tests {
+		config := &shared.Config{Schedules: []shared.Schedule{{Name: "test", From: test.from, To: test.to, Days: test.days, Lists: []string{"list"}}}}
+		now, _ := time.ParseInLocation("2006-01-02 15:04", test.time, time.Local)
+		if contains := newSchedules(config).lists["list"][0].contains(now); contains != test.expected {
+			t.Errorf("%s-%s %v at %s: expected %v, got %v", test.from, test.to, test.days, test.time, test.expected, contains)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"strings"
+)
+
+// Domain names stored by their labels in reverse, "ads.example.com." is found under "com" -> "example" -> "ads". Small
+// tries like the blacklist are built with insert and used as they are, tries for lists are built with add and frozen.
+type domainTrie struct {
+	root *trieNode
+	// Labels are shared between names instead of keeping the lines they were parsed from in memory
+	labels map[string]string
+	// Entries waiting for freeze, a flat list needs a fraction of the memory of the nodes while building
+	pending []trieEntry
+	// Set when frozen, replacing root
+	compact *compactTrie
+}
+
+// A rule for a normalized name, waiting to be added to the compact trie
+type trieEntry struct {
+	name       string
+	rule       *rule
+	self       bool
+	subdomains bool
+}
+
+type trieNode struct {
+	children map[string]*trieNode
+	// Rules matching the name itself
+	rules []*rule
+	// Rules matching any name under this one, but not the name itself
+	subdomains []*rule
+}
+
+func newDomainTrie() *domainTrie {
+	return &domainTrie{root: &trieNode{}, labels: map[string]string{}}
+}
+
+// Normalize name to the lowercase "domain.name." form used for lookups
+func normalizeName(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name = name + "."
+	}
+	return name
+}
+
+// Walk the labels of a normalized name from the last one to the first, stopping if fn returns false
+func walkLabels(name string, fn func(label string) bool) {
+	end := len(name) - 1 // Skip the trailing dot
+	for end > 0 {
+		start := strings.LastIndexByte(name[:end], '.') + 1
+		if !fn(name[start:end]) {
+			return
+		}
+		end = start - 1
+	}
+}
+
+// Add rule for name to be looked up once the trie is frozen, matching the name itself and/or all names under it
+func (t *domainTrie) add(name string, r *rule, self bool, subdomains bool) {
+	t.pending = append(t.pending, trieEntry{name: normalizeName(name), rule: r, self: self, subdomains: subdomains})
+}
+
+// Add rule for name to the trie, matching the name itself and/or all names under it. Returns false if the name
+// already had the rule.
+func (t *domainTrie) insert(name string, r *rule, self bool, subdomains bool) bool {
+	node := t.root
+	walkLabels(normalizeName(name), func(label string) bool {
+		child, ok := node.children[label]
+		if !ok {
+			if node.children == nil {
+				node.children = map[string]*trieNode{}
+			}
+
+			interned, ok := t.labels[label]
+			if !ok {
+				interned = string([]byte(label))
+				t.labels[interned] = interned
+			}
+
+			child = &trieNode{}
+			node.children[interned] = child
+		}
+		node = child
+		return true
+	})
+
+	added := false
+	if self && !hasRule(node.rules, r) {
+		node.rules = append(node.rules, r)
+		added = true
+	}
+	if subdomains && !hasRule(node.subdomains, r) {
+		node.subdomains = append(node.subdomains, r)
+		added = true
+	}
+
+	return added
+}
+
+func hasRule(rules []*rule, r *rule) bool {
+	for _, existing := range rules {
+		if existing == r {
+			return true
+		}
+	}
+	return false
+}
+
+// Find the most specific rule that matches the name and applies, exact matches win over parent domains unless the
+// parent domain's rule is important. Also returns the name the rule is for, e.g. "example.com." for a rule blocking
+// all of its subdomains.
+func (t *domainTrie) match(name string, applies func(r *rule) bool) (*rule, string) {
+	name = normalizeName(name)
+	if t.compact != nil {
+		return t.compact.match(name, applies)
+	}
+
+	var found *rule
+	foundDepth := 0
+
+	node := t.root
+	depth := 0
+	matched := true
+	walkLabels(name, func(label string) bool {
+		if r := pickRule(found, node.subdomains, applies); r != found {
+			found, foundDepth = r, depth
+		}
+
+		child, ok := node.children[label]
+		if !ok {
+			matched = false
+			return false
+		}
+		node = child
+		depth++
+		return true
+	})
+
+	if matched {
+		if r := pickRule(found, node.rules, applies); r != found {
+			found, foundDepth = r, depth
+		}
+	}
+
+	if found == nil {
+		return nil, ""
+	}
+
+	return found, nameSuffix(name, foundDepth)
+}
+
+// Get the last labels of a normalized name, which is the name of the trie node at that depth
+func nameSuffix(name string, labels int) string {
+	start := len(name) - 1
+	for ; labels > 0 && start > 0; labels-- {
+		start = strings.LastIndexByte(name[:start], '.')
+	}
+	return name[start+1:]
+}
+
+// Find every rule matching the name in the order match considers them
+func (t *domainTrie) matchAll(name string) []*rule {
+	if t.compact != nil {
+		return t.compact.matchAll(normalizeName(name))
+	}
+
+	found := []*rule{}
+
+	node := t.root
+	matched := true
+	walkLabels(normalizeName(name), func(label string) bool {
+		found = append(found, node.subdomains...)
+
+		child, ok := node.children[label]
+		if !ok {
+			matched = false
+			return false
+		}
+		node = child
+		return true
+	})
+
+	if matched {
+		found = append(found, node.rules...)
+	}
+
+	return found
+}
+
+// Pick the last rule that applies from rules over found, unless found is important and the rule is not
+func pickRule(found *rule, rules []*rule, applies func(r *rule) bool) *rule {
+	for _, r := range rules {
+		if (found == nil || r.important || !found.important) && applies(r) {
+			found = r
+		}
+	}
+	return found
+}
+
+// Replace the trie with a compact read-only version of the added entries, nothing can be added after this.
+// onDuplicate is called for every rule added more than once for the same name.
+func (t *domainTrie) freeze(onDuplicate func(r *rule)) {
+	if t.compact != nil {
+		return
+	}
+
+	t.compact = newCompactTrie(t.pending, onDuplicate)
+	t.pending = nil
+	t.root = nil
+	t.labels = nil
+}
+
+func (t *domainTrie) isEmpty() bool {
+	if t.compact != nil {
+		return t.compact.nodes[0].numChildren == 0
+	}
+	return len(t.root.children) == 0
+}
@@ -2,4 +2,9 @@ package shared
 
 type BlockEntry struct {
 	Src string
+	// Response Policy Zone that triggered the block, if it came from one
+	Zone string
+	// The rule as written in the list and its line number, only kept when explaining why a name is blocked
+	Rule string
+	Line int
 }
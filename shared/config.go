@@ -1,31 +1,156 @@
 package shared
 
 import (
+	"fmt"
+	"github.com/miekg/dns"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
+	"net"
 	"os"
 	"path"
 	"strings"
+	"time"
 )
 
+// A block or allow list source, can be given as just the URL or with extra options
+type ListConfig struct {
+	URL string `yaml:"url"`
+	// Every entry on the list also matches all of its subdomains
+	Subdomains bool `yaml:"subdomains"`
+	// Zone name for Response Policy Zone files that do not set their own $ORIGIN
+	Zone string `yaml:"zone"`
+	// How often to check for a new version of the list, e.g. 12h, overrides list_refresh
+	Refresh string `yaml:"refresh"`
+}
+
+// Entries that should never be blocked, no matter which lists or blacklist entries match them
+type Allowlist struct {
+	Names []string     `yaml:"names"`
+	Lists []ListConfig `yaml:"lists"`
+}
+
+const BlockingModeNullIP = "null_ip"
+const BlockingModeCustomIP = "custom_ip"
+const BlockingModeNxdomain = "nxdomain"
+const BlockingModeNodata = "nodata"
+const BlockingModeRefused = "refused"
+
+// How blocked requests are answered
+type BlockingConfig struct {
+	Mode string `yaml:"blocking_mode"`
+	// Blocking mode overrides by query type, e.g. HTTPS: nodata
+	Types map[string]string `yaml:"blocking_mode_types"`
+	// Sinkhole addresses for the custom_ip mode
+	IPv4 string `yaml:"blocking_ipv4"`
+	IPv6 string `yaml:"blocking_ipv6"`
+	TTL  uint32 `yaml:"blocked_ttl"`
+}
+
+// Settings for a group of clients, anything not set is the same as for everyone else
+type ClientGroup struct {
+	Name string `yaml:"name"`
+	// IP addresses, CIDR ranges or MAC addresses of the clients in the group
+	Clients    []string       `yaml:"clients"`
+	Blocking   BlockingConfig `yaml:",inline"`
+	Allowlist  Allowlist      `yaml:"allowlist"`
+	BlockLists []ListConfig   `yaml:"block_lists"`
+	Blacklist  []string       `yaml:"blacklist"`
+	DnsServers []string       `yaml:"dns_servers"`
+	SafeSearch *bool          `yaml:"safe_search"`
+}
+
+// Answer a name with the given record instead of resolving it
+type Rewrite struct {
+	// Exact name, or "*.domain" for all the names under domain
+	Name string `yaml:"name"`
+	// A, AAAA, CNAME, TXT or NXDOMAIN
+	Type string `yaml:"type"`
+	// Address, name or text of the record, without a value the type is answered with no records
+	Value string `yaml:"value"`
+}
+
+// Limits lists, blacklist patterns and client groups to certain times, or turns them off for that time
+type Schedule struct {
+	Name string `yaml:"name"`
+	// Weekdays, e.g. mon, tue, or everyday when not set
+	Days []string `yaml:"days"`
+	// Time range like 16:00 to 21:00, a range ending before it starts continues past midnight. Either one left out is
+	// midnight, and the same time for both or no range at all is the whole day.
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+	// Either enable (the items are only active during the schedule) or disable (they are inactive during it)
+	Mode      string   `yaml:"mode"`
+	Lists     []string `yaml:"lists"`
+	Blacklist []string `yaml:"blacklist"`
+	Groups    []string `yaml:"groups"`
+}
+
+const ScheduleEnable = "enable"
+const ScheduleDisable = "disable"
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
 type Config struct {
-	BlockLists []string `yaml:"block_lists"`
-	Blacklist  []string `yaml:"blacklist"`
-	DnsServers []string `yaml:"dns_servers"`
-	ListenHost string   `yaml:"listen_host"`
-	LogLevel   string   `yaml:"log_level"`
+	Blocking      BlockingConfig      `yaml:",inline"`
+	Allowlist     Allowlist           `yaml:"allowlist"`
+	BlockLists    []ListConfig        `yaml:"block_lists"`
+	Blacklist     []string            `yaml:"blacklist"`
+	DnsServers    []string            `yaml:"dns_servers"`
+	Forwarding    map[string][]string `yaml:"forwarding"`
+	Groups        []ClientGroup       `yaml:"groups"`
+	HostsFiles    []string            `yaml:"hosts_files"`
+	IpBlockLists  []ListConfig        `yaml:"ip_block_lists"`
+	IpBlockPolicy string              `yaml:"ip_block_policy"`
+	ListRefresh   string              `yaml:"list_refresh"`
+	ListenHost    string              `yaml:"listen_host"`
+	LogLevel      string              `yaml:"log_level"`
+	Rewrites      []Rewrite           `yaml:"rewrites"`
+	RpzZones      []ListConfig        `yaml:"rpz_zones"`
+	// Log or block internationalized names mixing scripts or imitating the brands, or off
+	HomographPolicy string   `yaml:"homograph_policy"`
+	HomographBrands []string `yaml:"homograph_brands"`
+	// Reverse lookups for private addresses go to these, or get NXDOMAIN if there are none
+	PrivateReverseDnsServers []string `yaml:"private_reverse_dns_servers"`
+	// Block (the whole response) or strip private addresses in the answers for public names, or off
+	RebindProtection string   `yaml:"rebind_protection"`
+	RebindAllowlist  []string `yaml:"rebind_allowlist"`
+	// Force search engines and YouTube to their safe or restricted modes
+	SafeSearch bool       `yaml:"safe_search"`
+	Schedules  []Schedule `yaml:"schedules"`
+	// Serve the names in /etc/hosts, or the Windows equivalent, off by default as they often map names to the machine
+	// itself
+	SystemHosts bool `yaml:"system_hosts"`
+	// Time zone for the schedules, e.g. Europe/Helsinki, the system's own by default
+	Timezone string `yaml:"timezone"`
+}
+
+func (l *ListConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&l.URL); err == nil {
+		return nil
+	}
+
+	type plain ListConfig
+	return unmarshal((*plain)(l))
 }
 
 // Some sensible lists that seem to cause little to no problems
-var defaultBlockLists = []string{
-	"https://raw.githubusercontent.com/StevenBlack/hosts/master/hosts",
-	"https://mirror1.malwaredomains.com/files/justdomains",
-	"http://sysctl.org/cameleon/hosts",
-	"https://s3.amazonaws.com/lists.disconnect.me/simple_tracking.txt",
-	"https://s3.amazonaws.com/lists.disconnect.me/simple_ad.txt",
-	"https://hosts-file.net/ad_servers.txt",
-	"https://pgl.yoyo.org/adservers/serverlist.php?hostformat=hosts&showintro=0&mimetype=plaintext",
+var defaultBlockLists = []ListConfig{
+	{URL: "https://raw.githubusercontent.com/StevenBlack/hosts/master/hosts"},
+	{URL: "https://mirror1.malwaredomains.com/files/justdomains"},
+	{URL: "http://sysctl.org/cameleon/hosts"},
+	{URL: "https://s3.amazonaws.com/lists.disconnect.me/simple_tracking.txt"},
+	{URL: "https://s3.amazonaws.com/lists.disconnect.me/simple_ad.txt"},
+	{URL: "https://hosts-file.net/ad_servers.txt"},
+	{URL: "https://pgl.yoyo.org/adservers/serverlist.php?hostformat=hosts&showintro=0&mimetype=plaintext"},
 }
 
 // Cloudflare's DNS-over-HTTPS and DNS-over-TLS servers seem like good defaults, one likely works
@@ -34,6 +159,13 @@ var defaultDnsServers = []string{
 	"dns+tls://1.0.0.1",
 }
 
+// Often imitated names for the homograph protection
+var defaultHomographBrands = []string{
+	"amazon", "apple", "bankofamerica", "chase", "dropbox", "ebay", "facebook", "github", "google", "icloud",
+	"instagram", "linkedin", "microsoft", "netflix", "office", "outlook", "paypal", "twitter", "wellsfargo",
+	"whatsapp", "yahoo",
+}
+
 // Blacklist Web Proxy Auto-Discovery protocol by default for minor speedup
 var defaultBlacklist = []string{
 	"wpad.*",
@@ -59,9 +191,179 @@ func (c *Config) GetBlacklist() []string {
 	return c.Blacklist
 }
 
-func validate(c Config) {
-	haveErrors := false
-	for _, uri := range c.DnsServers {
+func (c *Config) GetAllowlist() []string {
+	// String arrays are thread safe, right?
+	return c.Allowlist.Names
+}
+
+// Get the settings for the group, using the ones from c for anything the group doesn't set
+func (g ClientGroup) Merge(c *Config) ClientGroup {
+	if g.Blocking.Mode == "" {
+		g.Blocking.Mode = c.Blocking.Mode
+	}
+	if g.Blocking.Types == nil {
+		g.Blocking.Types = c.Blocking.Types
+	}
+	if g.Blocking.IPv4 == "" {
+		g.Blocking.IPv4 = c.Blocking.IPv4
+	}
+	if g.Blocking.IPv6 == "" {
+		g.Blocking.IPv6 = c.Blocking.IPv6
+	}
+	if g.Blocking.TTL == 0 {
+		g.Blocking.TTL = c.Blocking.TTL
+	}
+	if g.Allowlist.Names == nil {
+		g.Allowlist.Names = c.GetAllowlist()
+	}
+	if g.Allowlist.Lists == nil {
+		g.Allowlist.Lists = c.Allowlist.Lists
+	}
+	if g.BlockLists == nil {
+		g.BlockLists = c.BlockLists
+	}
+	if g.Blacklist == nil {
+		g.Blacklist = c.GetBlacklist()
+	}
+	if g.DnsServers == nil {
+		g.DnsServers = c.GetDnsServers()
+	}
+	if g.SafeSearch == nil {
+		g.SafeSearch = &c.SafeSearch
+	}
+
+	return g
+}
+
+// Parse a client IP address or CIDR range as a network, or a MAC address
+func ParseClient(client string) (*net.IPNet, net.HardwareAddr, error) {
+	if mac, err := net.ParseMAC(client); err == nil {
+		return nil, mac, nil
+	}
+
+	if _, network, err := net.ParseCIDR(client); err == nil {
+		return network, nil, nil
+	}
+
+	ip := net.ParseIP(client)
+	if ip == nil {
+		return nil, nil, fmt.Errorf("not an IP address, CIDR range or MAC address")
+	}
+
+	bits := 128
+	if ip.To4() != nil {
+		ip = ip.To4()
+		bits = 32
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil, nil
+}
+
+// Parse a weekday name like "mon" or "Monday"
+func ParseWeekday(day string) (time.Weekday, error) {
+	day = strings.ToLower(day)
+	if len(day) >= 3 {
+		if weekday, ok := weekdays[day[:3]]; ok {
+			return weekday, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown weekday %s", day)
+}
+
+// Parse a time of day like 16:30 to minutes since midnight
+func ParseTimeOfDay(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %s, should look like 16:30", value)
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Get the location for the schedules
+func (c *Config) GetTimezone() (*time.Location, error) {
+	if c.Timezone == "" {
+		return time.Local, nil
+	}
+
+	return time.LoadLocation(c.Timezone)
+}
+
+// Parse a list refresh interval, "0" or "never" disables refreshing
+func ParseRefresh(refresh string) time.Duration {
+	if refresh == "never" {
+		return 0
+	}
+
+	d, err := time.ParseDuration(refresh)
+	if err != nil {
+		return 0
+	}
+
+	return d
+}
+
+func validateRefresh(refresh string) bool {
+	if refresh == "never" {
+		return true
+	}
+
+	if _, err := time.ParseDuration(refresh); err != nil {
+		log.Errorf("Invalid list refresh interval %s: %s", refresh, err)
+		log.Errorf("Should look like: 30m, 12h, or never")
+		return false
+	}
+
+	return true
+}
+
+func validateBlockingMode(mode string, c BlockingConfig) bool {
+	switch mode {
+	case BlockingModeNullIP, BlockingModeNxdomain, BlockingModeNodata, BlockingModeRefused:
+	case BlockingModeCustomIP:
+		if c.IPv4 == "" && c.IPv6 == "" {
+			log.Errorf("Blocking mode %s needs blocking_ipv4 and/or blocking_ipv6 set", mode)
+			return false
+		}
+	default:
+		log.Errorf("Unsupported blocking mode: %s", mode)
+		log.Errorf("Should be one of: null_ip, custom_ip, nxdomain, nodata, refused")
+		return false
+	}
+
+	return true
+}
+
+func validateBlocking(c BlockingConfig) bool {
+	valid := validateBlockingMode(c.Mode, c)
+
+	for name, mode := range c.Types {
+		if _, ok := dns.StringToType[strings.ToUpper(name)]; !ok {
+			log.Errorf("Unknown query type in blocking_mode_types: %s", name)
+			valid = false
+		}
+		if !validateBlockingMode(mode, c) {
+			valid = false
+		}
+	}
+
+	if c.IPv4 != "" && (net.ParseIP(c.IPv4) == nil || net.ParseIP(c.IPv4).To4() == nil) {
+		log.Errorf("Invalid blocking_ipv4 address: %s", c.IPv4)
+		valid = false
+	}
+
+	if c.IPv6 != "" && net.ParseIP(c.IPv6) == nil {
+		log.Errorf("Invalid blocking_ipv6 address: %s", c.IPv6)
+		valid = false
+	}
+
+	return valid
+}
+
+func validateDnsServers(dnsServers []string) bool {
+	valid := true
+	for _, uri := range dnsServers {
 		if strings.HasPrefix(uri, "dns://") {
 			log.Infof("Using insecure DNS server: %s", uri)
 		} else if strings.HasPrefix(uri, "https://") {
@@ -69,12 +371,216 @@ func validate(c Config) {
 		} else if strings.HasPrefix(uri, "dns+tls://") {
 			log.Infof("Using DNS over TLS server: %s", uri)
 		} else {
-			haveErrors = true
+			valid = false
 			log.Errorf("Unsupported DNS URI: %s.", uri)
 			log.Errorf("Should look like: https://1.1.1.1/dns-query dns+tls://1.1.1.1 or dns://1.1.1.1")
 		}
 	}
 
+	return valid
+}
+
+func validateLists(lists ...[]ListConfig) bool {
+	valid := true
+	for _, lists := range lists {
+		for _, list := range lists {
+			if list.Refresh != "" && !validateRefresh(list.Refresh) {
+				valid = false
+			}
+		}
+	}
+
+	return valid
+}
+
+func validateGroups(c Config) bool {
+	valid := true
+	names := map[string]bool{}
+	for _, g := range c.Groups {
+		if g.Name == "" {
+			log.Errorf("Client groups need a name")
+			valid = false
+		} else if names[g.Name] {
+			log.Errorf("Client group %s defined more than once", g.Name)
+			valid = false
+		}
+		names[g.Name] = true
+
+		for _, client := range g.Clients {
+			if _, _, err := ParseClient(client); err != nil {
+				log.Errorf("Invalid client %s in group %s: %s", client, g.Name, err)
+				valid = false
+			}
+		}
+
+		merged := g.Merge(&c)
+		if g.DnsServers != nil && !validateDnsServers(g.DnsServers) {
+			valid = false
+		}
+		if !validateBlocking(merged.Blocking) {
+			valid = false
+		}
+		if !validateLists(g.BlockLists, g.Allowlist.Lists) {
+			valid = false
+		}
+	}
+
+	return valid
+}
+
+func validateRewrite(r Rewrite) bool {
+	name := strings.TrimPrefix(r.Name, "*.")
+	if name == "" || strings.Contains(name, "*") {
+		log.Errorf("Invalid rewrite name %s, should be a name or *.domain", r.Name)
+		return false
+	}
+
+	valid := true
+	switch strings.ToUpper(r.Type) {
+	case "A":
+		if ip := net.ParseIP(r.Value); r.Value != "" && (ip == nil || ip.To4() == nil) {
+			valid = false
+		}
+	case "AAAA":
+		if ip := net.ParseIP(r.Value); r.Value != "" && (ip == nil || ip.To4() != nil) {
+			valid = false
+		}
+	case "CNAME":
+		if _, ok := dns.IsDomainName(r.Value); r.Value != "" && !ok {
+			valid = false
+		}
+	case "TXT", "NXDOMAIN":
+	default:
+		log.Errorf("Unsupported rewrite type %s for %s", r.Type, r.Name)
+		log.Errorf("Should be one of: A, AAAA, CNAME, TXT, NXDOMAIN")
+		return false
+	}
+
+	if !valid {
+		log.Errorf("Invalid %s rewrite value %s for %s", r.Type, r.Value, r.Name)
+	}
+
+	return valid
+}
+
+func validateSchedules(c Config) bool {
+	valid := true
+	if _, err := c.GetTimezone(); err != nil {
+		log.Errorf("Invalid timezone %s: %s", c.Timezone, err)
+		valid = false
+	}
+
+	groups := map[string]bool{}
+	for _, g := range c.Groups {
+		groups[g.Name] = true
+	}
+
+	for _, s := range c.Schedules {
+		for _, day := range s.Days {
+			if _, err := ParseWeekday(day); err != nil {
+				log.Errorf("Invalid schedule %s: %s", s.Name, err)
+				valid = false
+			}
+		}
+
+		for _, value := range []string{s.From, s.To} {
+			// Left out it's midnight, so without either the schedule covers the whole day
+			if value == "" {
+				continue
+			}
+			if _, err := ParseTimeOfDay(value); err != nil {
+				log.Errorf("Invalid schedule %s: %s", s.Name, err)
+				valid = false
+			}
+		}
+
+		if s.Mode != "" && s.Mode != ScheduleEnable && s.Mode != ScheduleDisable {
+			log.Errorf("Unsupported schedule mode %s in schedule %s", s.Mode, s.Name)
+			log.Errorf("Should be either enable or disable")
+			valid = false
+		}
+
+		for _, group := range s.Groups {
+			if !groups[group] {
+				log.Errorf("Unknown client group %s in schedule %s", group, s.Name)
+				valid = false
+			}
+		}
+	}
+
+	return valid
+}
+
+func validate(c Config) {
+	haveErrors := false
+	if !validateDnsServers(c.DnsServers) {
+		haveErrors = true
+	}
+
+	if !validateBlocking(c.Blocking) {
+		haveErrors = true
+	}
+
+	if !validateDnsServers(c.PrivateReverseDnsServers) {
+		haveErrors = true
+	}
+
+	for domain, dnsServers := range c.Forwarding {
+		if _, ok := dns.IsDomainName(domain); !ok || len(dnsServers) == 0 {
+			log.Errorf("Invalid forwarding for %s, should be a domain and a list of DNS servers", domain)
+			haveErrors = true
+		} else if !validateDnsServers(dnsServers) {
+			haveErrors = true
+		}
+	}
+
+	if !validateRefresh(c.ListRefresh) {
+		haveErrors = true
+	}
+
+	if !validateLists(c.BlockLists, c.Allowlist.Lists, c.IpBlockLists, c.RpzZones) {
+		haveErrors = true
+	}
+
+	if !validateGroups(c) {
+		haveErrors = true
+	}
+
+	if !validateSchedules(c) {
+		haveErrors = true
+	}
+
+	for _, r := range c.Rewrites {
+		if !validateRewrite(r) {
+			haveErrors = true
+		}
+	}
+
+	if c.IpBlockPolicy != "block" && c.IpBlockPolicy != "strip" {
+		haveErrors = true
+		log.Errorf("Unsupported IP block policy: %s", c.IpBlockPolicy)
+		log.Errorf("Should be either block (block the whole response) or strip (remove the blocked addresses)")
+	}
+
+	if c.RebindProtection != "off" && c.RebindProtection != "block" && c.RebindProtection != "strip" {
+		haveErrors = true
+		log.Errorf("Unsupported rebind protection: %s", c.RebindProtection)
+		log.Errorf("Should be one of: off, block (block the whole response), strip (remove the private addresses)")
+	}
+
+	if c.HomographPolicy != "off" && c.HomographPolicy != "log" && c.HomographPolicy != "block" {
+		haveErrors = true
+		log.Errorf("Unsupported homograph policy: %s", c.HomographPolicy)
+		log.Errorf("Should be one of: off, log, block")
+	}
+
+	for _, domain := range c.RebindAllowlist {
+		if _, ok := dns.IsDomainName(domain); !ok {
+			haveErrors = true
+			log.Errorf("Invalid domain %s in rebind allowlist", domain)
+		}
+	}
+
 	if haveErrors {
 		panic("Cannot continue with invalid configuration.")
 	}
@@ -82,11 +588,20 @@ func validate(c Config) {
 
 func NewConfig(src string, usingDefault bool) *Config {
 	c := Config{
-		BlockLists: defaultBlockLists,
-		Blacklist:  defaultBlacklist,
-		DnsServers: defaultDnsServers,
-		ListenHost: "127.0.0.1",
-		LogLevel:   "info",
+		Blocking: BlockingConfig{
+			Mode: BlockingModeNullIP,
+			TTL:  2,
+		},
+		BlockLists:       defaultBlockLists,
+		Blacklist:        defaultBlacklist,
+		DnsServers:       defaultDnsServers,
+		HomographBrands:  defaultHomographBrands,
+		HomographPolicy:  "off",
+		IpBlockPolicy:    "block",
+		ListRefresh:      "24h",
+		ListenHost:       "127.0.0.1",
+		LogLevel:         "info",
+		RebindProtection: "off",
 	}
 
 	if _, err := os.Stat(src); os.IsNotExist(err) {
@@ -0,0 +1,155 @@
+package stats
+
+import (
+	"github.com/lietu/better-dns/shared"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How many of the most hit rules are tracked, the rest are forgotten
+const maxRuleHits = 1000
+
+// How often the hits are saved, they're also saved when exiting
+const hitsSaveInterval = 5 * time.Minute
+
+// How many times each list and the most hit rules blocked or allowed something, kept across restarts. List entries do
+// not keep their text, so rules are identified by their list and the name, pattern or network they are for, e.g.
+// "||doubleclick.net^" is counted as "doubleclick.net" for all of its subdomains.
+type Hits struct {
+	Lists map[string]uint64 `yaml:"lists"`
+	Rules map[string]uint64 `yaml:"rules"`
+}
+
+type Hit struct {
+	Name  string
+	Count uint64
+}
+
+var hits = Hits{Lists: map[string]uint64{}, Rules: map[string]uint64{}}
+var hitsMutex = &sync.Mutex{}
+
+func hitsFile() string {
+	return filepath.Join(shared.GetConfigDir(), "hits.yaml")
+}
+
+// Count a hit for the list and the rule for the matched name, pattern or network
+func countHit(be *shared.BlockEntry, matched string) {
+	hitsMutex.Lock()
+	defer hitsMutex.Unlock()
+
+	hits.Lists[be.Src]++
+
+	key := be.Src + " " + strings.TrimSuffix(matched, ".")
+	if _, ok := hits.Rules[key]; !ok && len(hits.Rules) >= maxRuleHits {
+		// Replace the least hit rule, taking over its count as the new one could have been hit while not tracked
+		leastKey := ""
+		var least uint64
+		for k, count := range hits.Rules {
+			if leastKey == "" || count < least {
+				leastKey = k
+				least = count
+			}
+		}
+		delete(hits.Rules, leastKey)
+		hits.Rules[key] = least
+	}
+	hits.Rules[key]++
+}
+
+// Get a copy of the hits
+func GetHits() Hits {
+	hitsMutex.Lock()
+	defer hitsMutex.Unlock()
+
+	latest := Hits{Lists: map[string]uint64{}, Rules: map[string]uint64{}}
+	for list, count := range hits.Lists {
+		latest.Lists[list] = count
+	}
+	for rule, count := range hits.Rules {
+		latest.Rules[rule] = count
+	}
+
+	return latest
+}
+
+// Get the n most hit from counts, most hit first
+func TopHits(counts map[string]uint64, n int) []Hit {
+	top := []Hit{}
+	for name, count := range counts {
+		top = append(top, Hit{Name: name, Count: count})
+	}
+
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].Name < top[j].Name
+	})
+
+	if len(top) > n {
+		top = top[:n]
+	}
+
+	return top
+}
+
+// Load the hits saved by a previous run
+func LoadHits() {
+	data, err := ioutil.ReadFile(hitsFile())
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Errorf("Failed to read hits: %s", err)
+		return
+	}
+
+	loaded := Hits{}
+	if err := yaml.Unmarshal(data, &loaded); err != nil {
+		log.Errorf("Failed to parse hits from %s: %s", hitsFile(), err)
+		return
+	}
+
+	hitsMutex.Lock()
+	defer hitsMutex.Unlock()
+	for list, count := range loaded.Lists {
+		hits.Lists[list] += count
+	}
+	for rule, count := range loaded.Rules {
+		if len(hits.Rules) < maxRuleHits {
+			hits.Rules[rule] += count
+		}
+	}
+}
+
+func SaveHits() {
+	data, err := yaml.Marshal(GetHits())
+	if err != nil {
+		log.Errorf("Failed to save hits: %s", err)
+		return
+	}
+
+	// Written to a temporary file first so a crash can't leave a partial file behind
+	tmp := hitsFile() + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		log.Errorf("Failed to save hits: %s", err)
+		return
+	}
+	if err := os.Rename(tmp, hitsFile()); err != nil {
+		log.Errorf("Failed to save hits: %s", err)
+	}
+}
+
+// Keep saving the hits periodically
+func PersistHits() {
+	for {
+		time.Sleep(hitsSaveInterval)
+		SaveHits()
+	}
+}
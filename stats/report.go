@@ -5,21 +5,52 @@ import (
 	"github.com/lietu/better-dns/shared"
 	"github.com/miekg/dns"
 	log "github.com/sirupsen/logrus"
+	"net"
 	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Stats struct {
+	Allowed   uint64
 	Blocked   uint64
 	Cached    uint64
 	Errors    uint64
 	Successes uint64
 	Rtt       time.Duration
+	// Blocked requests by client group
+	GroupBlocked map[string]uint64
 }
 
-var stats = Stats{0, 0, 0, 0, 0}
+var stats = Stats{0, 0, 0, 0, 0, 0, map[string]uint64{}}
 
-func answerResult(a dns.RR) string {
+// Unlike the counters, concurrent map updates would crash
+var groupMutex = &sync.Mutex{}
+
+// Blocked and allowed requests are reported from their own goroutines, so they're counted atomically
+func countBlocked(group string) {
+	atomic.AddUint64(&stats.Blocked, 1)
+	if group == "" {
+		return
+	}
+
+	groupMutex.Lock()
+	defer groupMutex.Unlock()
+	stats.GroupBlocked[group]++
+}
+
+// Describe the client group for logging
+func forGroup(group string) string {
+	if group == "" {
+		return ""
+	}
+	return fmt.Sprintf(" for %s", group)
+}
+
+// Describe the answer by its address, name or text
+func AnswerResult(a dns.RR) string {
 	if a, ok := a.(*dns.A); ok {
 		return a.A.String()
 	}
@@ -44,6 +75,10 @@ func answerResult(a dns.RR) string {
 		return a.Target
 	}
 
+	if a, ok := a.(*dns.TXT); ok {
+		return strings.Join(a.Txt, " ")
+	}
+
 	return fmt.Sprintf("unknown (%T)", a)
 }
 
@@ -119,7 +154,7 @@ func ReportSuccess(req *dns.Msg, res *dns.Msg, rtt time.Duration, server string)
 	ans := answerList[0]
 	ttl := time.Second * time.Duration(ans.Header().Ttl)
 	extra = fmt.Sprintf(" (+%d more)", answers-1)
-	result := answerResult(ans)
+	result := AnswerResult(ans)
 
 	log.Debugf("✔ %s (%s) is %s%s for %s (%s)", CleanName(name), t, result, extra, CleanDuration(ttl), CleanDuration(rtt))
 	stats.Successes++
@@ -140,7 +175,7 @@ func ReportCached(req *dns.Msg, res *dns.Msg) {
 	result := "none"
 	answers := len(res.Answer)
 	if answers > 0 {
-		result = answerResult(res.Answer[0])
+		result = AnswerResult(res.Answer[0])
 	}
 
 	extra := ""
@@ -152,7 +187,28 @@ func ReportCached(req *dns.Msg, res *dns.Msg) {
 	stats.Cached++
 }
 
-func ReportBlocked(req *dns.Msg, be *shared.BlockEntry) {
+func ReportLocal(req *dns.Msg, res *dns.Msg, src string) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Errorf("Suppressing panic during ReportLocal: %s", err)
+		}
+	}()
+
+	q := req.Question[0]
+	result := dns.RcodeToString[res.Rcode]
+	if len(res.Answer) > 0 {
+		result = AnswerResult(res.Answer[0])
+	}
+
+	extra := ""
+	if len(res.Answer) > 1 {
+		extra = fmt.Sprintf(" (+%d more)", len(res.Answer)-1)
+	}
+
+	log.Debugf("✔ %s (%s) is %s%s from %s", CleanName(q.Name), dns.TypeToString[q.Qtype], result, extra, src)
+}
+
+func ReportBlocked(req *dns.Msg, be *shared.BlockEntry, matched string, group string) {
 	defer func() {
 		if err := recover(); err != nil {
 			log.Errorf("Suppressing panic during ReportBlocked: %s", err)
@@ -160,13 +216,106 @@ func ReportBlocked(req *dns.Msg, be *shared.BlockEntry) {
 	}()
 
 	name := req.Question[0].Name
-	log.Debugf("⛔ %s blocked by %s", CleanName(name), be.Src)
-	stats.Blocked++
+	if be.Zone != "" {
+		log.Debugf("⛔ %s blocked by %s (RPZ %s)%s", CleanName(name), be.Src, be.Zone, forGroup(group))
+	} else {
+		log.Debugf("⛔ %s blocked by %s%s", CleanName(name), be.Src, forGroup(group))
+	}
+	countBlocked(group)
+	countHit(be, matched)
+}
+
+func ReportCnameBlocked(req *dns.Msg, target string, be *shared.BlockEntry, matched string, group string) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Errorf("Suppressing panic during ReportCnameBlocked: %s", err)
+		}
+	}()
+
+	name := req.Question[0].Name
+	log.Debugf("⛔ %s blocked by %s via CNAME %s%s", CleanName(name), be.Src, CleanName(target), forGroup(group))
+	countBlocked(group)
+	countHit(be, matched)
+}
+
+func ReportIPBlocked(req *dns.Msg, ip net.IP, network *net.IPNet, be *shared.BlockEntry, stripped bool, group string) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Errorf("Suppressing panic during ReportIPBlocked: %s", err)
+		}
+	}()
+
+	name := req.Question[0].Name
+	countHit(be, network.String())
+	if stripped {
+		log.Debugf("⛔ %s answer %s stripped, %s blocked by %s%s", CleanName(name), ip, network, be.Src, forGroup(group))
+		return
+	}
+
+	log.Debugf("⛔ %s blocked by %s, answer %s is in %s%s", CleanName(name), be.Src, ip, network, forGroup(group))
+	countBlocked(group)
+}
+
+func ReportHomograph(req *dns.Msg, be *shared.BlockEntry, decoded string, reason string, blocked bool, group string) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Errorf("Suppressing panic during ReportHomograph: %s", err)
+		}
+	}()
+
+	name := req.Question[0].Name
+	if !blocked {
+		log.Infof("⚠ %s (%s) flagged by %s, %s%s", CleanName(name), decoded, be.Src, reason, forGroup(group))
+		return
+	}
+
+	log.Debugf("⛔ %s (%s) blocked by %s, %s%s", CleanName(name), decoded, be.Src, reason, forGroup(group))
+	countBlocked(group)
+	countHit(be, CleanName(name))
+}
+
+func ReportAllowed(req *dns.Msg, blocked *shared.BlockEntry, allowed *shared.BlockEntry, matched string, group string) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Errorf("Suppressing panic during ReportAllowed: %s", err)
+		}
+	}()
+
+	name := req.Question[0].Name
+	log.Debugf("✅ %s allowed by %s, overriding block by %s%s", CleanName(name), allowed.Src, blocked.Src, forGroup(group))
+	atomic.AddUint64(&stats.Allowed, 1)
+	countHit(allowed, matched)
+}
+
+func ReportRewritten(req *dns.Msg, target string, reason string, group string) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Errorf("Suppressing panic during ReportRewritten: %s", err)
+		}
+	}()
+
+	name := req.Question[0].Name
+	log.Debugf("↪ %s rewritten to %s by %s%s", CleanName(name), strings.TrimSuffix(target, "."), reason, forGroup(group))
 }
 
 func GetStats() Stats {
-	latest := stats
+	latest := Stats{
+		Allowed:   atomic.LoadUint64(&stats.Allowed),
+		Blocked:   atomic.LoadUint64(&stats.Blocked),
+		Cached:    stats.Cached,
+		Errors:    stats.Errors,
+		Successes: stats.Successes,
+		Rtt:       stats.Rtt,
+	}
 	stats.Rtt = 0 // Reset Rtt calculation
+
+	groupMutex.Lock()
+	defer groupMutex.Unlock()
+	latest.GroupBlocked = map[string]uint64{}
+	for group, count := range stats.GroupBlocked {
+		latest.GroupBlocked[group] = count
+	}
+
 	return latest
 }
 